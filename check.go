@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/fengxsong/queryexporter/pkg/collector"
+	"github.com/fengxsong/queryexporter/pkg/config"
+	"github.com/fengxsong/queryexporter/pkg/querier/factory"
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+const (
+	resultPass = "PASS"
+	resultFail = "FAIL"
+	resultSkip = "SKIP"
+)
+
+type checkOptions struct {
+	configFile string
+	expandEnv  bool
+	namespace  string
+	connect    bool
+	timeout    time.Duration
+}
+
+// runCheck validates and lints the config file, and optionally pings every server
+// and runs every query once. It returns the exit code.
+func runCheck(logger *slog.Logger, opts checkOptions, w io.Writer) int {
+	cfg, err := config.ReadFromFile(opts.configFile, opts.expandEnv)
+	if err != nil {
+		fmt.Fprintf(w, "%s: %s\n", resultFail, err)
+		return 1
+	}
+	failed := false
+	// registering the collector reports conflicting descriptors between metrics
+	c, err := collector.New(opts.namespace, cfg, logger, collector.WithRegisterer(prometheus.NewRegistry()))
+	if err == nil {
+		err = prometheus.NewRegistry().Register(c)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s: %s\n\n", resultFail, err)
+		failed = true
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	if opts.connect {
+		fmt.Fprintln(tw, "SERVER\tDRIVER\tRESULT\tDETAIL")
+		for _, s := range serversOf(cfg) {
+			ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+			err := factory.Default.Ping(ctx, s.driver, s.ds)
+			cancel()
+			result, detail := resultPass, "reachable"
+			switch {
+			case errors.Is(err, factory.ErrNotSupported):
+				result, detail = resultSkip, err.Error()
+			case err != nil:
+				result, detail = resultFail, err.Error()
+				failed = true
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.ds.Name, s.driver, result, detail)
+		}
+		fmt.Fprintln(tw)
+	}
+
+	problems := cfg.Lint(opts.namespace)
+	fmt.Fprintln(tw, "METRIC\tDRIVER\tRESULT\tDETAIL")
+	for _, driver := range sortedDrivers(cfg) {
+		for _, m := range cfg.Aggregations[driver] {
+			result, detail := resultPass, "ok"
+			if issues := problems[driver][m.Name]; len(issues) > 0 {
+				result, detail = resultFail, strings.Join(issues, "; ")
+			} else if opts.connect {
+				ctx, cancel := context.WithTimeout(factory.WithVars(context.Background(), cfg.Vars), opts.timeout)
+				metrics, err := collectMetric(ctx, logger, opts.namespace, string(driver), m)
+				cancel()
+				if err != nil {
+					result, detail = resultFail, err.Error()
+				} else {
+					detail = fmt.Sprintf("%d series", len(metrics))
+				}
+			}
+			if result == resultFail {
+				failed = true
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", m.Name, driver, result, detail)
+		}
+	}
+	tw.Flush()
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+type serverRef struct {
+	driver string
+	ds     *types.DataSource
+}
+
+// serversOf returns every server referenced by datasources of aggregations together with
+// its driver. A server used by several drivers is returned once for each driver.
+func serversOf(cfg *config.Config) []serverRef {
+	var (
+		refs []serverRef
+		seen = make(map[string]struct{})
+	)
+	for _, driver := range sortedDrivers(cfg) {
+		for _, m := range cfg.Aggregations[driver] {
+			for _, ds := range m.DataSources {
+				key := string(driver) + "/" + ds.Name
+				if _, ok := seen[key]; ok {
+					continue
+				}
+				seen[key] = struct{}{}
+				refs = append(refs, serverRef{driver: string(driver), ds: ds})
+			}
+		}
+	}
+	return refs
+}
+
+func sortedDrivers(cfg *config.Config) []types.DataSourceType {
+	drivers := make([]types.DataSourceType, 0, len(cfg.Aggregations))
+	for driver := range cfg.Aggregations {
+		drivers = append(drivers, driver)
+	}
+	sort.Slice(drivers, func(i, j int) bool { return drivers[i] < drivers[j] })
+	return drivers
+}
+
+// collectMetric runs the metric once against all its datasources and returns the produced series,
+// continueIfError is ignored so that every error is reported.
+func collectMetric(ctx context.Context, logger *slog.Logger, namespace, driver string, m *types.Metric) ([]prometheus.Metric, error) {
+	desc := *m.MetricDesc
+	desc.ContinueIfError = false
+
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	var metrics []prometheus.Metric
+	go func() {
+		defer close(done)
+		for metric := range ch {
+			metrics = append(metrics, metric)
+		}
+	}()
+	err := factory.Default.Process(ctx, logger, namespace, driver, m.DataSources, &desc, ch)
+	close(ch)
+	<-done
+	return metrics, err
+}
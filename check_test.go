@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fengxsong/queryexporter/pkg/config"
+)
+
+// newTestServer serves body as JSON with status code for every request
+func newTestServer(t *testing.T, code int, body string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// writeConfig writes a config with a single http metric named name against uri
+func writeConfig(t *testing.T, name, uri string) string {
+	t.Helper()
+	config := fmt.Sprintf(`
+servers:
+  - name: api
+    uri: %s
+aggregations:
+  http:
+    - name: %s
+      query: "uri: /orders"
+      variableValue: count
+      variableLabels: [status]
+      datasources:
+        - name: api
+`, uri, name)
+	fn := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(fn, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+const testTimeout = 5 * time.Second
+
+// readConfig reads the config file fn
+func readConfig(t *testing.T, fn string) *config.Config {
+	t.Helper()
+	cfg, err := config.ReadFromFile(fn, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestRunCheck(t *testing.T) {
+	ok := newTestServer(t, http.StatusOK, `[{"status": "paid", "count": 3}]`)
+	failing := newTestServer(t, http.StatusInternalServerError, "boom")
+	tests := []struct {
+		name    string
+		metric  string
+		uri     string
+		connect bool
+		code    int
+		want    []string
+	}{
+		{name: "lint only", metric: "orders", uri: failing.URL, code: 0, want: []string{"orders", "PASS", "ok"}},
+		{name: "lint failure", metric: "orders_total", uri: ok.URL, code: 1, want: []string{"should not have suffix _total"}},
+		{name: "connect", metric: "orders", uri: ok.URL, connect: true, code: 0, want: []string{"reachable", "1 series"}},
+		{name: "query failure", metric: "orders", uri: failing.URL, connect: true, code: 1, want: []string{"500 Internal Server Error"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			opts := checkOptions{
+				configFile: writeConfig(t, tt.metric, tt.uri),
+				namespace:  "test_check",
+				connect:    tt.connect,
+				timeout:    5 * time.Second,
+			}
+			if code := runCheck(discardLogger, opts, &out); code != tt.code {
+				t.Fatalf("got exit code %d, want %d, output:\n%s", code, tt.code, out.String())
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(out.String(), want) {
+					t.Fatalf("output does not contain %q:\n%s", want, out.String())
+				}
+			}
+		})
+	}
+}
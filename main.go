@@ -1,16 +1,24 @@
 package main
 
 import (
+	"context"
+	"log/slog"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	versioncollector "github.com/prometheus/client_golang/prometheus/collectors/version"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/promslog"
 	"github.com/prometheus/common/promslog/flag"
 	"github.com/prometheus/common/version"
@@ -19,19 +27,19 @@ import (
 
 	"github.com/fengxsong/queryexporter/pkg/collector"
 	"github.com/fengxsong/queryexporter/pkg/config"
+	"github.com/fengxsong/queryexporter/pkg/output"
+	"github.com/fengxsong/queryexporter/pkg/querier/factory"
 )
 
 const app = "queryexporter"
 
-func init() {
-	prometheus.MustRegister(versioncollector.NewCollector(app))
-}
-
 func main() {
-	os.Exit(run())
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+	os.Exit(run(os.Args[1:], term))
 }
 
-func newLandingPage(metricsPath, healthzPath string) (http.Handler, error) {
+func newLandingPage(metricsPath, selfMetricsPath, healthzPath, readyPath string) (http.Handler, error) {
 	landingConfig := web.LandingConfig{
 		Name:        app,
 		Description: "exporter for many database sources",
@@ -40,12 +48,22 @@ func newLandingPage(metricsPath, healthzPath string) (http.Handler, error) {
 			{
 				Address:     metricsPath,
 				Text:        "Metrics",
-				Description: "for self-metrics or running in single target mode",
+				Description: "for metrics transformed from query results",
+			},
+			{
+				Address:     selfMetricsPath,
+				Text:        "Self Metrics",
+				Description: "for metrics of the exporter itself",
 			},
 			{
 				Address:     healthzPath,
 				Text:        "Healthz",
-				Description: "for liveness or readiness probe",
+				Description: "for liveness probe",
+			},
+			{
+				Address:     readyPath,
+				Text:        "Ready",
+				Description: "for readiness probe, reflects connectivity of servers",
 			},
 		},
 	}
@@ -53,25 +71,194 @@ func newLandingPage(metricsPath, healthzPath string) (http.Handler, error) {
 	return web.NewLandingPage(landingConfig)
 }
 
-func run() int {
+// scrapeTimeoutOffset is left of timeouts announced by Prometheus, so that metrics
+// collected so far arrive before the scrape times out
+const scrapeTimeoutOffset = 500 * time.Millisecond
+
+// scrapeDeadline returns the deadline of the scrape announced by Prometheus in the
+// X-Prometheus-Scrape-Timeout-Seconds header, zero if there's none.
+func scrapeDeadline(r *http.Request) time.Time {
+	seconds, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+	if err != nil || seconds <= 0 {
+		return time.Time{}
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > 2*scrapeTimeoutOffset {
+		timeout -= scrapeTimeoutOffset
+	}
+	return time.Now().Add(timeout)
+}
+
+// scrapeGatherer gathers metrics of queryReg, and of c until deadline of the scrape
+// it is used by, which is set before every scrape.
+type scrapeGatherer struct {
+	c        prometheus.Collector
+	queryReg prometheus.Gatherer
+	deadline time.Time
+}
+
+func (g *scrapeGatherer) Gather() ([]*dto.MetricFamily, error) {
+	scrapeReg := prometheus.NewRegistry()
+	if err := scrapeReg.Register(collector.Until(g.c, g.deadline)); err != nil {
+		return nil, err
+	}
+	return prometheus.Gatherers{g.queryReg, scrapeReg}.Gather()
+}
+
+// scrapeHandler is a handler of metrics bound to its own gatherer, handlers are reused
+// by scrapes one at a time so that they are built once rather than on every scrape.
+type scrapeHandler struct {
+	gatherer *scrapeGatherer
+	http.Handler
+}
+
+// newMetricsHandlers returns handlers of metrics from c and queryReg, and of selfReg.
+// c is gathered until the deadline of every scrape, errors and requests of the former
+// are instrumented in selfReg. OpenMetrics is negotiated with scrapers.
+func newMetricsHandlers(logger *slog.Logger, c prometheus.Collector, queryReg, selfReg *prometheus.Registry) (http.Handler, http.Handler) {
+	errorLog := slog.NewLogLogger(logger.Handler(), slog.LevelError)
+	opts := promhttp.HandlerOpts{
+		ErrorLog:          errorLog,
+		Registry:          selfReg,
+		EnableOpenMetrics: true,
+	}
+	handlers := sync.Pool{New: func() any {
+		g := &scrapeGatherer{c: c, queryReg: queryReg}
+		return &scrapeHandler{gatherer: g, Handler: promhttp.HandlerFor(g, opts)}
+	}}
+	metrics := promhttp.InstrumentMetricHandler(selfReg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := handlers.Get().(*scrapeHandler)
+		defer handlers.Put(h)
+		h.gatherer.deadline = scrapeDeadline(r)
+		h.ServeHTTP(w, r)
+	}))
+	selfMetrics := promhttp.HandlerFor(selfReg, promhttp.HandlerOpts{
+		ErrorLog:          errorLog,
+		EnableOpenMetrics: true,
+	})
+	return metrics, selfMetrics
+}
+
+// run runs the command of args, serving metrics until term receives a signal
+func run(args []string, term <-chan os.Signal) int {
+	cli := kingpin.New(app, "")
 	var (
-		toolkitFlags = webflag.AddFlags(kingpin.CommandLine, ":9696")
+		toolkitFlags = webflag.AddFlags(cli, ":9696")
 
-		metricsPath = kingpin.Flag(
+		metricsPath = cli.Flag(
 			"web.telemetry-path",
 			"Path under which to expose metrics.").Default("/metrics").String()
-		configF   = kingpin.Flag("config", "Path of config file").Short('c').Default("config.yaml").String()
-		expandEnv = kingpin.Flag("expand-env", "Expand env in config file, for reading secrets from environment variables").Default("false").Bool()
-		test      = kingpin.Flag("test", "Print rendered content of config file").Short('t').Default("false").Bool()
-		namespace = kingpin.Flag("namespace", "Namespace for metrics").Short('n').Default(app).String()
+		selfMetricsPath = cli.Flag(
+			"web.self-telemetry-path",
+			"Path under which to expose metrics of the exporter itself.").Default("/self-metrics").String()
+		includeGo = cli.Flag(
+			"web.telemetry-path.include-go-metrics",
+			"Also expose Go runtime metrics under web.telemetry-path, they are always exposed under web.self-telemetry-path.").Default("false").Bool()
+		includeProcess = cli.Flag(
+			"web.telemetry-path.include-process-metrics",
+			"Also expose process metrics under web.telemetry-path, they are always exposed under web.self-telemetry-path.").Default("false").Bool()
+		configF     = cli.Flag("config", "Path of config file").Short('c').Default("config.yaml").String()
+		expandEnv   = cli.Flag("expand-env", "Expand env in config file, for reading secrets from environment variables").Default("false").Bool()
+		test        = cli.Flag("test", "Print rendered content of config file").Short('t').Default("false").Bool()
+		namespace   = cli.Flag("namespace", "Namespace for metrics").Short('n').Default(app).String()
+		gracePeriod = cli.Flag("shutdown.grace-period",
+			"Time to wait for in-flight scrapes on shutdown before cancelling their queries").Default("30s").Duration()
+		scrapeTimeout = cli.Flag("scrape.timeout",
+			"Timeout of a scrape, metrics collected so far are returned then and queries no scrape waits for are cancelled. Timeouts sent by Prometheus are bounded by it, zero means no timeout other than those").Default("0s").Duration()
+		readyPolicy = cli.Flag("readiness.policy",
+			"Ready when all or any of the servers are reachable").Default(readyPolicyAll).Enum(readyPolicyAll, readyPolicyAny)
+		readyServers = cli.Flag("readiness.server",
+			"Only take this server into account for readiness, can be repeated").Strings()
+		readyInterval = cli.Flag("readiness.interval", "Interval of pinging servers in background").Default("30s").Duration()
+		readyTimeout  = cli.Flag("readiness.timeout", "Timeout of each ping").Default("10s").Duration()
+
+		serveCmd     = cli.Command("serve", "Run exporter and expose metrics over HTTP").Default()
+		schemaCmd    = cli.Command("schema", "Generate JSON Schema of the config file")
+		schemaOutput = schemaCmd.Flag("output", "Write schema to file instead of stdout").Short('o').String()
+		checkCmd     = cli.Command("check", "Validate and lint config file, optionally test connectivity")
+		checkConfig  = checkCmd.Arg("config-file", "Path of config file, overrides --config").String()
+		checkConnect = checkCmd.Flag("connect", "Ping every server and run every query once").Default("false").Bool()
+		checkTimeout = checkCmd.Flag("timeout", "Timeout of each ping or query").Default("30s").Duration()
+		queryCmd     = cli.Command("query", "Run a single metric once and print its query, results and series")
+		queryMetric  = queryCmd.Flag("metric", "Name of metric to run").Required().String()
+		queryDriver  = queryCmd.Flag("driver", "Only run the metric of this driver").String()
+		queryDS      = queryCmd.Flag("datasource", "Only run against this datasource").String()
+		queryTimeout = queryCmd.Flag("timeout", "Timeout of the query").Default("30s").Duration()
+
+		exportCmd      = cli.Command("export", "Run all metrics and write them into a file for the textfile collector of node_exporter")
+		exportDir      = exportCmd.Flag("dir", "Directory to write file into, usually the --collector.textfile.directory of node_exporter").Required().ExistingDir()
+		exportFilename = exportCmd.Flag("filename", "Name of file, must have suffix .prom").Default(app + ".prom").String()
+		exportInterval = exportCmd.Flag("interval", "Rerun every interval until terminated, run once if zero").Default("0s").Duration()
+
+		pushCmd      = cli.Command("push", "Run all metrics and push them to a Prometheus Pushgateway")
+		pushURL      = pushCmd.Flag("url", "URL of the Pushgateway").Required().String()
+		pushJob      = pushCmd.Flag("job", "Job name of pushed metrics").Default(app).String()
+		pushInterval = pushCmd.Flag("interval", "Push every interval until terminated, push once if zero").Default("0s").Duration()
+
+		rwCmd           = cli.Command("remote-write", "Run all metrics and send samples to a Prometheus remote write receiver")
+		rwURL           = rwCmd.Flag("url", "URL of the remote write receiver").Required().String()
+		rwInterval      = rwCmd.Flag("interval", "Send every interval until terminated, send once if zero").Default("1m").Duration()
+		rwHeaders       = rwCmd.Flag("header", "Extra HTTP header in KEY=VALUE form, e.g. X-Scope-OrgID=tenant").StringMap()
+		rwBatchSize     = rwCmd.Flag("batch-size", "Maximum number of samples per request").Default("2000").Int()
+		rwQueueCapacity = rwCmd.Flag("queue-capacity", "Maximum number of samples queued in memory while the receiver is unavailable").Default("100000").Int()
+		rwMaxRetries    = rwCmd.Flag("max-retries", "Maximum retries of a request on recoverable errors").Default("3").Int()
+		rwTimeout       = rwCmd.Flag("timeout", "Timeout of each request").Default("30s").Duration()
+
+		otlpCmd      = cli.Command("otlp", "Run all metrics and send them to an OpenTelemetry collector via OTLP/HTTP")
+		otlpURL      = otlpCmd.Flag("url", "URL of the OTLP/HTTP metrics endpoint").Default("http://localhost:4318/v1/metrics").String()
+		otlpService  = otlpCmd.Flag("service-name", "Value of the service.name resource attribute").Default(app).String()
+		otlpInterval = otlpCmd.Flag("interval", "Send every interval until terminated, send once if zero").Default("1m").Duration()
+		otlpHeaders  = otlpCmd.Flag("header", "Extra HTTP header in KEY=VALUE form").StringMap()
+		otlpTimeout  = otlpCmd.Flag("timeout", "Timeout of each request").Default("30s").Duration()
 	)
 	promslogConfig := &promslog.Config{}
 
-	flag.AddFlags(kingpin.CommandLine, promslogConfig)
-	kingpin.Version(version.Print(app))
-	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	flag.AddFlags(cli, promslogConfig)
+	cli.Version(version.Print(app))
+	cli.HelpFlag.Short('h')
+	cmd := kingpin.MustParse(cli.Parse(args))
 	logger := promslog.New(promslogConfig)
+	// clients of drivers are cached, close them to not leave sessions open on databases
+	defer func() {
+		if err := factory.Default.Close(); err != nil {
+			logger.Error("failed to close drivers", "err", err)
+		}
+	}()
+
+	switch cmd {
+	case schemaCmd.FullCommand():
+		if err := writeSchema(*schemaOutput); err != nil {
+			logger.Error("failed to generate schema", "err", err)
+			return 1
+		}
+		return 0
+	case checkCmd.FullCommand():
+		if *checkConfig != "" {
+			*configF = *checkConfig
+		}
+		return runCheck(logger, checkOptions{
+			configFile: *configF,
+			expandEnv:  *expandEnv,
+			namespace:  *namespace,
+			connect:    *checkConnect,
+			timeout:    *checkTimeout,
+		}, os.Stdout)
+	case queryCmd.FullCommand():
+		if err := runQuery(logger, queryOptions{
+			configFile: *configF,
+			expandEnv:  *expandEnv,
+			namespace:  *namespace,
+			metric:     *queryMetric,
+			driver:     *queryDriver,
+			datasource: *queryDS,
+			timeout:    *queryTimeout,
+		}, os.Stdout); err != nil {
+			logger.Error("failed to run query", "err", err)
+			return 1
+		}
+		return 0
+	case serveCmd.FullCommand():
+	}
 
 	cfg, err := config.ReadFromFile(*configF, *expandEnv)
 	if err != nil {
@@ -83,49 +270,176 @@ func run() int {
 		config.Dump(cfg, os.Stdout)
 		return 0
 	}
-	c, err := collector.New(*namespace, cfg, logger)
+	// metrics of the exporter itself are kept apart from metrics transformed from query results
+	selfReg := prometheus.NewRegistry()
+	selfReg.MustRegister(
+		versioncollector.NewCollector(app),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	// collections in flight are waited for before closing clients of drivers, while pings
+	// in background only return once queries are cancelled
+	var inflight, background sync.WaitGroup
+	defer inflight.Wait()
+	defer background.Wait()
+	queryCtx, cancelQueries := context.WithCancel(context.Background())
+	defer cancelQueries()
+	opts := []collector.Option{
+		collector.WithRegisterer(selfReg),
+		collector.WithContext(queryCtx),
+		collector.WithScrapeTimeout(*scrapeTimeout),
+		collector.WithWaitGroup(&inflight),
+	}
+	if cmd == rwCmd.FullCommand() || cmd == otlpCmd.FullCommand() {
+		opts = append(opts, collector.WithTimestamps())
+	}
+	c, err := collector.New(*namespace, cfg, logger, opts...)
 	if err != nil {
 		logger.Error("failed to create collector", "err", err)
 		return 1
 	}
 
-	prometheus.MustRegister(c)
+	if cmd == exportCmd.FullCommand() {
+		if !strings.HasSuffix(*exportFilename, ".prom") {
+			logger.Error("filename must have suffix .prom", "filename", *exportFilename)
+			return 1
+		}
+		return runOutput(logger, c, cancelQueries, output.NewTextfile(*exportDir, *exportFilename), *exportInterval)
+	}
+	if cmd == pushCmd.FullCommand() {
+		return runOutput(logger, c, cancelQueries, output.NewPushgateway(*pushURL, *pushJob, modulesOf(*namespace, cfg)), *pushInterval)
+	}
+	if cmd == rwCmd.FullCommand() {
+		return runOutput(logger, c, cancelQueries, output.NewRemoteWrite(logger, *rwURL, output.RemoteWriteOptions{
+			BatchSize:     *rwBatchSize,
+			QueueCapacity: *rwQueueCapacity,
+			MaxRetries:    *rwMaxRetries,
+			MinBackoff:    30 * time.Millisecond,
+			MaxBackoff:    5 * time.Second,
+			Timeout:       *rwTimeout,
+			Headers:       *rwHeaders,
+		}), *rwInterval)
+	}
+	if cmd == otlpCmd.FullCommand() {
+		return runOutput(logger, c, cancelQueries, output.NewOTLP(*otlpURL, *otlpService, *otlpHeaders, *otlpTimeout, modulesOf(*namespace, cfg)), *otlpInterval)
+	}
+
+	// descriptors are checked once, scrapes gather the collector with their own deadline
+	if err = prometheus.NewRegistry().Register(c); err != nil {
+		logger.Error("failed to register collector", "err", err)
+		return 1
+	}
+	queryReg := prometheus.NewRegistry()
+	if *includeGo {
+		queryReg.MustRegister(collectors.NewGoCollector())
+	}
+	if *includeProcess {
+		queryReg.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	}
 
-	http.Handle(*metricsPath, promhttp.Handler())
+	metricsHandler, selfMetricsHandler := newMetricsHandlers(logger, c, queryReg, selfReg)
+	mux := http.NewServeMux()
+	// profiles are registered on the default mux by net/http/pprof
+	mux.Handle("/debug/pprof/", http.DefaultServeMux)
+	mux.Handle(*metricsPath, metricsHandler)
+	mux.Handle(*selfMetricsPath, selfMetricsHandler)
 
 	healthzPath := "/-/healthy"
-	http.HandleFunc(healthzPath, func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc(healthzPath, func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("Healthy"))
 	})
 
-	landingPage, err := newLandingPage(*metricsPath, healthzPath)
+	ready, err := newReadiness(logger, cfg, *readyPolicy, *readyServers, *readyInterval, *readyTimeout)
+	if err != nil {
+		logger.Error("failed to create readiness", "err", err)
+		return 1
+	}
+	background.Add(2)
+	go func() {
+		defer background.Done()
+		openClients(queryCtx, logger, cfg)
+	}()
+	go func() {
+		defer background.Done()
+		ready.run(queryCtx)
+	}()
+	readyPath := "/-/ready"
+	mux.Handle(readyPath, ready)
+
+	landingPage, err := newLandingPage(*metricsPath, *selfMetricsPath, healthzPath, readyPath)
 	if err != nil {
 		logger.Error("failed to create landing page", "err", err)
 		return 1
 	}
 
-	http.Handle("/", landingPage)
+	mux.Handle("/", landingPage)
 
-	srv := &http.Server{}
+	srv := &http.Server{Handler: mux}
 	srvc := make(chan struct{})
-	term := make(chan os.Signal, 1)
-	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
-		if err := web.ListenAndServe(srv, toolkitFlags, logger); err != nil {
+		if err := web.ListenAndServe(srv, toolkitFlags, logger); err != nil && err != http.ErrServerClosed {
 			logger.Error("error starting HTTP server", "err", err)
 			close(srvc)
 		}
 	}()
 
-	for {
-		select {
-		case <-term:
-			logger.Info("received SIGTERM, exiting gracefully")
-			return 0
-		case <-srvc:
-			return 1
-		}
+	select {
+	case <-term:
+		logger.Info("received SIGTERM, exiting gracefully", "grace_period", *gracePeriod)
+		return shutdown(logger, srv, *gracePeriod, cancelQueries, &inflight)
+	case <-srvc:
+		return 1
+	}
+}
+
+// openClients opens clients of all servers ahead of the first scrape, servers that
+// fail are opened again by queries.
+func openClients(ctx context.Context, logger *slog.Logger, cfg *config.Config) {
+	var wg sync.WaitGroup
+	for _, ref := range serversOf(cfg) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := factory.Default.Open(ctx, ref.driver, ref.ds); err != nil {
+				logger.Warn("failed to open client", "server", ref.ds.Name, "driver", ref.driver, "err", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// shutdown stops accepting new scrapes and waits for in-flight scrapes and collections
+// until the grace period passes, queries still running then are cancelled. It returns
+// non-zero if the grace period was exceeded.
+func shutdown(logger *slog.Logger, srv *http.Server, gracePeriod time.Duration, cancelQueries context.CancelFunc, inflight *sync.WaitGroup) int {
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if err == nil {
+		err = wait(ctx, inflight)
+	}
+	cancelQueries()
+	if err != nil {
+		logger.Warn("grace period exceeded, cancelled in-flight queries", "err", err)
+		srv.Close()
+		return 1
+	}
+	return 0
+}
+
+// wait waits for wg until ctx is done
+func wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/fengxsong/queryexporter/pkg/collector"
+)
+
+func TestMetricsHandlers(t *testing.T) {
+	queryReg, selfReg := prometheus.NewRegistry(), prometheus.NewRegistry()
+	queryReg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_go_info", Help: "Go info."}))
+	c := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_mysql_orders", Help: "Orders."})
+	metrics, selfMetrics := newMetricsHandlers(discardLogger, c, queryReg, selfReg)
+
+	tests := []struct {
+		name        string
+		handler     http.Handler
+		accept      string
+		contentType string
+		contains    []string
+		excludes    []string
+	}{
+		{
+			name:        "text format by default",
+			handler:     metrics,
+			contentType: "text/plain",
+			contains:    []string{"test_mysql_orders 0", "test_go_info 0"},
+			excludes:    []string{"# EOF", "promhttp_metric_handler_requests_total"},
+		},
+		{
+			name:        "negotiates OpenMetrics",
+			handler:     metrics,
+			accept:      "application/openmetrics-text; version=1.0.0",
+			contentType: "application/openmetrics-text",
+			contains:    []string{"test_mysql_orders 0", "# EOF"},
+		},
+		{
+			name:        "self-metrics instrument the metrics handler",
+			handler:     selfMetrics,
+			contentType: "text/plain",
+			contains:    []string{`promhttp_metric_handler_requests_total{code="200"} 2`},
+			excludes:    []string{"test_mysql_orders"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			tt.handler.ServeHTTP(rec, req)
+			if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, tt.contentType) {
+				t.Fatalf("got content type %s, want %s", ct, tt.contentType)
+			}
+			body, _ := io.ReadAll(rec.Body)
+			for _, want := range tt.contains {
+				if !strings.Contains(string(body), want) {
+					t.Fatalf("body does not contain %q:\n%s", want, body)
+				}
+			}
+			for _, unwanted := range tt.excludes {
+				if strings.Contains(string(body), unwanted) {
+					t.Fatalf("body contains %q:\n%s", unwanted, body)
+				}
+			}
+		})
+	}
+}
+
+func TestMetricsHandlersScrapeDeadline(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(300 * time.Millisecond):
+			fmt.Fprint(w, `[{"count": 1, "status": "ok"}]`)
+		case <-r.Context().Done():
+		}
+	}))
+	defer backend.Close()
+	var running sync.WaitGroup
+	c, err := collector.New("queryexporter", readConfig(t, writeConfig(t, "orders", backend.URL)), discardLogger,
+		collector.WithRegisterer(prometheus.NewRegistry()), collector.WithWaitGroup(&running))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, _ := newMetricsHandlers(discardLogger, c, prometheus.NewRegistry(), prometheus.NewRegistry())
+
+	// handlers are reused by scrapes, the deadline of a scrape doesn't outlive it
+	tests := []struct {
+		name    string
+		timeout string
+		want    bool
+	}{
+		{name: "deadline passed before queries return", timeout: "0.1"},
+		{name: "no deadline", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.timeout != "" {
+				req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", tt.timeout)
+			}
+			rec := httptest.NewRecorder()
+			metrics.ServeHTTP(rec, req)
+			// the next scrape starts a collection of its own
+			running.Wait()
+			if got := strings.Contains(rec.Body.String(), "queryexporter_http_orders"); got != tt.want {
+				t.Fatalf("got orders %v, want %v:\n%s", got, tt.want, rec.Body)
+			}
+		})
+	}
+}
+
+func TestScrapeDeadline(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    time.Duration
+		wantSet bool
+	}{
+		{name: "no header"},
+		{name: "malformed", header: "soon"},
+		{name: "negative", header: "-1"},
+		{name: "offset left", header: "10", want: 10*time.Second - scrapeTimeoutOffset, wantSet: true},
+		{name: "fraction", header: "2.5", want: 2*time.Second + 500*time.Millisecond - scrapeTimeoutOffset, wantSet: true},
+		{name: "too short for offset", header: "0.5", want: 500 * time.Millisecond, wantSet: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.header != "" {
+				req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", tt.header)
+			}
+			now := time.Now()
+			deadline := scrapeDeadline(req)
+			if deadline.IsZero() == tt.wantSet {
+				t.Fatalf("got deadline %v, want set %v", deadline, tt.wantSet)
+			}
+			if !tt.wantSet {
+				return
+			}
+			if got := deadline.Sub(now); got < tt.want || got > tt.want+time.Second {
+				t.Fatalf("got timeout %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	tests := []struct {
+		name       string
+		request    time.Duration
+		collection time.Duration
+		want       int
+	}{
+		{name: "idle", want: 0},
+		{name: "scrape within grace period", request: 50 * time.Millisecond, want: 0},
+		{name: "collection within grace period", collection: 50 * time.Millisecond, want: 0},
+		{name: "scrape exceeding grace period", request: 5 * time.Second, want: 1},
+		{name: "collection exceeding grace period", collection: 5 * time.Second, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queryCtx, cancelQueries := context.WithCancel(context.Background())
+			defer cancelQueries()
+			// both requests and collections return early once queries are cancelled
+			block := func(d time.Duration) {
+				select {
+				case <-time.After(d):
+				case <-queryCtx.Done():
+				}
+			}
+			started := make(chan struct{})
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				close(started)
+				block(tt.request)
+			})}
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go srv.Serve(ln)
+			if tt.request > 0 {
+				go http.Get("http://" + ln.Addr().String())
+				<-started
+			}
+			var inflight sync.WaitGroup
+			inflight.Add(1)
+			go func() {
+				defer inflight.Done()
+				block(tt.collection)
+			}()
+
+			start := time.Now()
+			if got := shutdown(discardLogger, srv, time.Second, cancelQueries, &inflight); got != tt.want {
+				t.Fatalf("got exit code %d, want %d", got, tt.want)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Fatalf("shutdown took %s beyond the grace period", elapsed)
+			}
+			if queryCtx.Err() == nil {
+				t.Fatal("queries are not cancelled")
+			}
+		})
+	}
+}
+
+func TestRunShutdown(t *testing.T) {
+	tests := []struct {
+		name   string
+		scrape bool
+		want   int
+	}{
+		{name: "idle", want: 0},
+		{name: "scrape exceeding grace period", scrape: true, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// queries block until they are cancelled
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+			}))
+			defer backend.Close()
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr := ln.Addr().String()
+			ln.Close()
+
+			const gracePeriod = time.Second
+			term := make(chan os.Signal, 1)
+			code := make(chan int)
+			go func() {
+				code <- run([]string{
+					"serve",
+					"--config", writeConfig(t, "orders", backend.URL),
+					"--web.listen-address", addr,
+					"--shutdown.grace-period", gracePeriod.String(),
+					"--log.level", "error",
+				}, term)
+			}()
+			for {
+				resp, err := http.Get("http://" + addr + "/-/healthy")
+				if err == nil {
+					resp.Body.Close()
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if tt.scrape {
+				go http.Get("http://" + addr + "/metrics")
+				time.Sleep(100 * time.Millisecond)
+			}
+
+			start := time.Now()
+			term <- syscall.SIGTERM
+			select {
+			case got := <-code:
+				if got != tt.want {
+					t.Fatalf("got exit code %d, want %d", got, tt.want)
+				}
+			case <-time.After(testTimeout):
+				t.Fatal("run does not return after SIGTERM")
+			}
+			// pings and clients opened in background don't hold shutdown until the grace period
+			if elapsed := time.Since(start); tt.want == 0 && elapsed >= gracePeriod {
+				t.Fatalf("shutdown took %s, want less than the grace period", elapsed)
+			}
+		})
+	}
+}
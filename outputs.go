@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/fengxsong/queryexporter/pkg/config"
+	"github.com/fengxsong/queryexporter/pkg/output"
+)
+
+// modulesOf maps fully-qualified names of metrics defined in cfg to their drivers
+func modulesOf(namespace string, cfg *config.Config) map[string]string {
+	modules := make(map[string]string)
+	for driver, metrics := range cfg.Aggregations {
+		for _, m := range metrics {
+			modules[prometheus.BuildFQName(namespace, string(driver), m.Name)] = string(driver)
+		}
+	}
+	return modules
+}
+
+// runOutput registers c into a dedicated registry and exports it with e, once or
+// every interval until terminated, in-flight queries are cancelled by cancelQueries
+// on termination. It returns the exit code.
+func runOutput(logger *slog.Logger, c prometheus.Collector, cancelQueries context.CancelFunc, e output.Exporter, interval time.Duration) int {
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(c); err != nil {
+		logger.Error("failed to register collector", "err", err)
+		return 1
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		cancelQueries()
+	}()
+
+	if err := output.Run(ctx, logger, reg, e, interval); err != nil {
+		logger.Error("failed to export metrics", "err", err)
+		return 1
+	}
+	return 0
+}
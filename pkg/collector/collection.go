@@ -0,0 +1,150 @@
+package collector
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// collection is a run of all metrics shared by concurrent scrapes. Metrics are
+// buffered as they are produced, so scrapes joining later receive them as well.
+type collection struct {
+	// ctx bounds queries of the collection, it's cancelled once the deadline of
+	// every scrape waiting for the collection passed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu sync.Mutex
+	// metrics are only appended, so scrapes read them without copying
+	metrics []prometheus.Metric
+	// changed is created by a scrape waiting for metrics, and closed on the next
+	// change, so that metrics added while no scrape waits notify nobody
+	changed chan struct{}
+	done    bool
+	// deadline is the latest deadline of scrapes joined, timer cancels ctx once it
+	// passes. timer is nil if any scrape joined without deadline.
+	deadline time.Time
+	timer    *time.Timer
+}
+
+func newCollection(parent context.Context, deadline time.Time) *collection {
+	ctx, cancel := context.WithCancel(parent)
+	c := &collection{cancel: cancel, deadline: deadline}
+	c.ctx = deadlineContext{Context: ctx, c: c}
+	if !deadline.IsZero() {
+		c.timer = time.AfterFunc(time.Until(deadline), cancel)
+	}
+	return c
+}
+
+// deadlineContext reports the deadline of the collection as its own, so that queries
+// tell whether retries end in time. The deadline only moves later as scrapes join.
+type deadlineContext struct {
+	context.Context
+	c *collection
+}
+
+func (ctx deadlineContext) Deadline() (time.Time, bool) {
+	deadline, ok := ctx.Context.Deadline()
+	ctx.c.mu.Lock()
+	defer ctx.c.mu.Unlock()
+	if ctx.c.timer != nil && (!ok || ctx.c.deadline.Before(deadline)) {
+		return ctx.c.deadline, true
+	}
+	return deadline, ok
+}
+
+// extend makes queries of the collection run until deadline of a scrape joining it,
+// a zero deadline lets them run until they are done.
+func (c *collection) extend(deadline time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer == nil || c.done {
+		return
+	}
+	if deadline.IsZero() {
+		c.timer.Stop()
+		c.timer = nil
+		return
+	}
+	if deadline.After(c.deadline) {
+		c.deadline = deadline
+		c.timer.Reset(time.Until(deadline))
+	}
+}
+
+func (c *collection) add(m prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metrics = append(c.metrics, m)
+	c.notifyLocked()
+}
+
+func (c *collection) finish() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.cancel()
+	c.notifyLocked()
+}
+
+func (c *collection) notifyLocked() {
+	if c.changed != nil {
+		close(c.changed)
+		c.changed = nil
+	}
+}
+
+// since returns metrics added after the first n ones and whether the collection is
+// done. If there are no such metrics, a channel closed on the next change is returned.
+func (c *collection) since(n int) ([]prometheus.Metric, <-chan struct{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n < len(c.metrics) || c.done {
+		return c.metrics[n:], nil, c.done
+	}
+	if c.changed == nil {
+		c.changed = make(chan struct{})
+	}
+	return nil, c.changed, false
+}
+
+// send forwards metrics of the collection to ch until it's done or deadline passes,
+// a zero deadline waits until it's done.
+func (c *collection) send(ch chan<- prometheus.Metric, deadline time.Time) {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	n := 0
+	for {
+		metrics, changed, done := c.since(n)
+		for _, m := range metrics {
+			ch <- m
+		}
+		n += len(metrics)
+		if done {
+			return
+		}
+		if changed == nil {
+			select {
+			case <-timeout:
+				return
+			default:
+			}
+			continue
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return
+		}
+	}
+}
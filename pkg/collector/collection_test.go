@@ -0,0 +1,167 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scrapeOf collects metrics of c until deadline and counts series of orders
+func scrapeOf(c *collector, deadline time.Time) int {
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	n := 0
+	go func() {
+		defer close(done)
+		for m := range ch {
+			if strings.Contains(m.Desc().String(), "queryexporter_http_orders") {
+				n++
+			}
+		}
+	}()
+	c.collectUntil(ch, deadline)
+	close(ch)
+	<-done
+	return n
+}
+
+// waitInflight waits until a collection of c is in flight
+func waitInflight(c *collector) {
+	for {
+		c.mu.Lock()
+		started := c.inflight != nil
+		c.mu.Unlock()
+		if started {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSharedCollection(t *testing.T) {
+	tests := []struct {
+		name string
+		// delay of the server, queries cancelled are not answered
+		delay time.Duration
+		// deadlines of the first scrape and of the one joining it, zero means none
+		first, joining time.Duration
+		wantFirst      int
+		wantJoining    int
+		wantCancelled  bool
+	}{
+		{name: "no deadlines", delay: 50 * time.Millisecond, wantFirst: 1, wantJoining: 1},
+		{name: "both in time", delay: 50 * time.Millisecond, first: 5 * time.Second, joining: 5 * time.Second, wantFirst: 1, wantJoining: 1},
+		{name: "joining scrape extends queries", delay: 300 * time.Millisecond, first: 100 * time.Millisecond, joining: 5 * time.Second, wantJoining: 1},
+		{name: "joining scrape without deadline", delay: 300 * time.Millisecond, first: 100 * time.Millisecond, wantJoining: 1},
+		{name: "every deadline passed", delay: 5 * time.Second, first: 100 * time.Millisecond, joining: 200 * time.Millisecond, wantCancelled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests, cancelled atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				select {
+				case <-time.After(tt.delay):
+					fmt.Fprint(w, `[{"count": 1}]`)
+				case <-r.Context().Done():
+					cancelled.Add(1)
+				}
+			}))
+			defer srv.Close()
+			cfg := readConfig(t, srv.URL, `
+aggregations:
+  http:
+    - name: orders
+      query: "uri: /orders"
+      variableValue: count
+      datasources:
+        - name: api
+`)
+			pc, err := New("queryexporter", cfg, nil, WithRegisterer(prometheus.NewRegistry()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := pc.(*collector)
+			deadlineOf := func(timeout time.Duration) time.Time {
+				if timeout == 0 {
+					return time.Time{}
+				}
+				return time.Now().Add(timeout)
+			}
+
+			var (
+				wg                sync.WaitGroup
+				gotFirst, gotJoin int
+			)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				gotFirst = scrapeOf(c, deadlineOf(tt.first))
+			}()
+			waitInflight(c)
+			gotJoin = scrapeOf(c, deadlineOf(tt.joining))
+			wg.Wait()
+
+			if gotFirst != tt.wantFirst || gotJoin != tt.wantJoining {
+				t.Fatalf("got %d and %d series, want %d and %d", gotFirst, gotJoin, tt.wantFirst, tt.wantJoining)
+			}
+			// the collection is done once queries return, and requests once the server is closed
+			c.running.Wait()
+			srv.Close()
+			if got := requests.Load(); got != 1 {
+				t.Fatalf("got %d requests, want 1", got)
+			}
+			if got := cancelled.Load() > 0; got != tt.wantCancelled {
+				t.Fatalf("got query cancelled %v, want %v", got, tt.wantCancelled)
+			}
+		})
+	}
+}
+
+func TestCollectionDeadline(t *testing.T) {
+	now := time.Now()
+	first, later := now.Add(time.Minute), now.Add(time.Hour)
+	tests := []struct {
+		name   string
+		parent time.Time
+		first  time.Time
+		joined []time.Time
+		want   time.Time
+	}{
+		{name: "no deadline"},
+		{name: "deadline of first scrape", first: first, want: first},
+		{name: "extended by joining scrape", first: first, joined: []time.Time{later}, want: later},
+		{name: "not shortened by joining scrape", first: later, joined: []time.Time{first}, want: later},
+		{name: "joining scrape without deadline", first: first, joined: []time.Time{{}}},
+		{name: "earlier deadline of parent", parent: first, first: later, want: first},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent, cancel := context.WithCancel(context.Background())
+			if !tt.parent.IsZero() {
+				parent, cancel = context.WithDeadline(context.Background(), tt.parent)
+			}
+			defer cancel()
+			col := newCollection(parent, tt.first)
+			defer col.finish()
+			for _, deadline := range tt.joined {
+				col.extend(deadline)
+			}
+			// queries see the deadline through contexts derived from the collection
+			ctx, cancel := context.WithCancel(col.ctx)
+			defer cancel()
+			got, ok := ctx.Deadline()
+			if ok != !tt.want.IsZero() || !got.Equal(tt.want) {
+				t.Fatalf("got deadline %v (set %v), want %v", got, ok, tt.want)
+			}
+		})
+	}
+}
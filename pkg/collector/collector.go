@@ -17,16 +17,73 @@ import (
 )
 
 type collector struct {
-	namespace string
+	namespace  string
+	timestamps bool
+	registerer prometheus.Registerer
+	// ctx is the parent of contexts of all queries, cancelling it cancels in-flight queries
+	ctx context.Context
 
-	cfg                *config.Config
+	cfg *config.Config
+	// factory runs queries within the concurrency limits, rate limits and circuit breakers of cfg
+	factory            *factory.Factory
 	logger             *slog.Logger
 	totalScrapes       *prometheus.CounterVec
 	scrapeDurationDesc *prometheus.Desc
-	lock               sync.Mutex
+	// scrapeTimeout bounds every scrape and the queries of collections, zero means unbounded
+	scrapeTimeout time.Duration
+
+	mu sync.Mutex
+	// inflight is the collection joined by concurrent scrapes
+	inflight *collection
+	// running counts collections in flight, including ones no scrape waits for anymore
+	running *sync.WaitGroup
+}
+
+// Option configures optional behaviors of the collector
+type Option func(*collector)
+
+// WithTimestamps makes metrics carry the time their result was read as timestamp,
+// which is needed when pushing samples to remote storages instead of being scraped.
+func WithTimestamps() Option {
+	return func(c *collector) {
+		c.timestamps = true
+	}
+}
+
+// WithRegisterer sets the registerer for self-metrics of the collector,
+// prometheus.DefaultRegisterer is used by default.
+func WithRegisterer(reg prometheus.Registerer) Option {
+	return func(c *collector) {
+		c.registerer = reg
+	}
+}
+
+// WithContext sets the parent context of queries, in-flight queries are cancelled
+// when it is done, e.g. on shutdown.
+func WithContext(ctx context.Context) Option {
+	return func(c *collector) {
+		c.ctx = ctx
+	}
 }
 
-func New(name string, cfg *config.Config, logger *slog.Logger) (prometheus.Collector, error) {
+// WithScrapeTimeout bounds the time of every scrape. Every scrape returns the metrics
+// collected so far when its own timeout passes, queries of a collection are cancelled
+// once no scrape waits for them anymore.
+func WithScrapeTimeout(timeout time.Duration) Option {
+	return func(c *collector) {
+		c.scrapeTimeout = timeout
+	}
+}
+
+// WithWaitGroup makes collections in flight counted by wg, so that clients of drivers
+// are closed only after every collection is done, e.g. on shutdown.
+func WithWaitGroup(wg *sync.WaitGroup) Option {
+	return func(c *collector) {
+		c.running = wg
+	}
+}
+
+func New(name string, cfg *config.Config, logger *slog.Logger, opts ...Option) (prometheus.Collector, error) {
 	if logger == nil {
 		logger = promslog.NewNopLogger()
 	}
@@ -38,7 +95,11 @@ func New(name string, cfg *config.Config, logger *slog.Logger) (prometheus.Colle
 
 	c := &collector{
 		namespace:    name,
+		registerer:   prometheus.DefaultRegisterer,
+		ctx:          context.Background(),
+		running:      &sync.WaitGroup{},
 		cfg:          cfg,
+		factory:      factory.New(),
 		logger:       logger,
 		totalScrapes: totalScrapes,
 		scrapeDurationDesc: prometheus.NewDesc(
@@ -47,19 +108,128 @@ func New(name string, cfg *config.Config, logger *slog.Logger) (prometheus.Colle
 			[]string{"driver", "metric"}, nil,
 		),
 	}
-	prometheus.MustRegister(c.totalScrapes)
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.factory.SetConcurrencyLimits(cfg.ConcurrencyLimits())
+	c.factory.SetRateLimits(cfg.RateLimits())
+	c.factory.SetCircuitBreakers(cfg.CircuitBreakers())
+	c.registerer.MustRegister(c.totalScrapes)
+	if err := prometheus.WrapRegistererWithPrefix(name+"_", c.registerer).Register(c.factory); err != nil {
+		return nil, err
+	}
 
 	return c, nil
 }
 
-func (c *collector) Describe(_ chan<- *prometheus.Desc) {}
+// Describe emits descriptors of all metrics derivable from config, so that the collector
+// is checked by the registry and conflicting label sets of metrics with the same
+// fully-qualified name are reported at registration instead of every scrape.
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.scrapeDurationDesc
+
+	seen := make(map[string]struct{})
+	for driver, metrics := range c.cfg.Aggregations {
+		for _, m := range metrics {
+			desc := m.ToDesc(c.namespace, string(driver), types.BuiltinLabels...)
+			// metrics defined more than once, e.g. for different datasources, share the same descriptor
+			if _, ok := seen[desc.String()]; ok {
+				continue
+			}
+			seen[desc.String()] = struct{}{}
+			ch <- desc
+		}
+	}
+}
 
+// Collect runs all metrics, scrapes arriving while a collection is in flight join
+// it and receive the same metrics instead of running every query again.
 func (c *collector) Collect(ch chan<- prometheus.Metric) {
-	c.lock.Lock()
-	defer c.lock.Unlock()
+	c.collectUntil(ch, time.Time{})
+}
+
+// collectUntil is like Collect, but the scrape returns metrics collected so far once
+// deadline passes. The scrape timeout bounds the deadline as well, zero means no
+// deadline other than the scrape timeout.
+func (c *collector) collectUntil(ch chan<- prometheus.Metric, deadline time.Time) {
+	if c.scrapeTimeout > 0 {
+		if timeout := time.Now().Add(c.scrapeTimeout); deadline.IsZero() || timeout.Before(deadline) {
+			deadline = timeout
+		}
+	}
+	c.mu.Lock()
+	col := c.inflight
+	if col == nil {
+		col = newCollection(c.ctx, deadline)
+		c.inflight = col
+		c.running.Add(1)
+		go func() {
+			defer c.running.Done()
+			c.collect(col)
+			c.mu.Lock()
+			c.inflight = nil
+			c.mu.Unlock()
+			col.finish()
+		}()
+	} else {
+		// queries keep running as long as any scrape waits for them
+		col.extend(deadline)
+	}
+	c.mu.Unlock()
+	col.send(ch, deadline)
+}
+
+// scrapeCollector collects metrics of a collector until the deadline of a scrape
+type scrapeCollector struct {
+	c        *collector
+	deadline time.Time
+}
+
+// Until returns a collector of the metrics of c, which is created by New, returning
+// metrics collected so far once deadline passes, e.g. the timeout announced by the
+// scraper. It describes nothing, so that it can be registered for every scrape
+// without checking descriptors again.
+func Until(c prometheus.Collector, deadline time.Time) prometheus.Collector {
+	col, ok := c.(*collector)
+	if !ok {
+		return c
+	}
+	return &scrapeCollector{c: col, deadline: deadline}
+}
+
+func (s *scrapeCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (s *scrapeCollector) Collect(ch chan<- prometheus.Metric) {
+	s.c.collectUntil(ch, s.deadline)
+}
+
+func (c *collector) collect(col *collection) {
+	ctx := col.ctx
+
+	// identical queries of different metrics are run once per scrape
+	scrape := factory.NewScrape()
+	for driver, metrics := range c.cfg.Aggregations {
+		for _, m := range metrics {
+			for _, ds := range m.DataSources {
+				scrape.Expect(string(driver), ds, m.Query)
+			}
+		}
+	}
 
 	wg := &sync.WaitGroup{}
-	ctx := context.Background()
+	ctx = factory.WithScrape(factory.WithVars(ctx, c.cfg.Vars), scrape)
+	if c.timestamps {
+		ctx = factory.WithTimestamps(ctx)
+	}
+
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for m := range ch {
+			col.add(m)
+		}
+	}()
 
 	for driver, metrics := range c.cfg.Aggregations {
 		for i := range metrics {
@@ -68,7 +238,7 @@ func (c *collector) Collect(ch chan<- prometheus.Metric) {
 				defer wg.Done()
 				start := time.Now()
 
-				err := factory.Default.Process(ctx, c.logger, c.namespace, subsystem, a.DataSources, a.MetricDesc, ch)
+				err := c.factory.Process(ctx, c.logger, c.namespace, subsystem, a.DataSources, a.MetricDesc, ch)
 				if err != nil {
 					c.logger.Error("failed to process", "err", err)
 				}
@@ -82,4 +252,6 @@ func (c *collector) Collect(ch chan<- prometheus.Metric) {
 		}
 	}
 	wg.Wait()
+	close(ch)
+	<-done
 }
@@ -0,0 +1,214 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/fengxsong/queryexporter/pkg/config"
+)
+
+// readConfig reads config from content, the uri of server api is set to uri
+func readConfig(t *testing.T, uri, content string) *config.Config {
+	t.Helper()
+	content = `
+servers:
+  - name: api
+    uri: ` + uri + "\n" + content
+	fn := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(fn, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.ReadFromFile(fn, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestDescribe(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{
+			name: "same metric for different datasources",
+			config: `
+aggregations:
+  http:
+    - name: orders
+      query: "uri: /orders"
+      variableValue: count
+      datasources:
+        - name: api
+    - name: orders
+      query: "uri: /v2/orders"
+      variableValue: count
+      datasources:
+        - name: api
+          database: v2
+`,
+		},
+		{
+			name: "same name with different labels",
+			config: `
+aggregations:
+  http:
+    - name: orders
+      query: "uri: /orders"
+      variableValue: count
+      datasources:
+        - name: api
+    - name: orders
+      query: "uri: /orders"
+      variableValue: count
+      variableLabels: [status]
+      datasources:
+        - name: api
+`,
+			wantErr: "queryexporter_http_orders",
+		},
+		{
+			name: "same name of different drivers",
+			config: `
+aggregations:
+  http:
+    - name: orders
+      query: "uri: /orders"
+      variableValue: count
+      datasources:
+        - name: api
+  redis:
+    - name: orders
+      query: GET orders
+      variableValue: value
+      datasources:
+        - name: api
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := readConfig(t, "redis://localhost:6379/0", tt.config)
+			c, err := New("queryexporter", cfg, nil, WithRegisterer(prometheus.NewRegistry()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = prometheus.NewRegistry().Register(c)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWithWaitGroup(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		fmt.Fprint(w, `[{"count": 1}]`)
+	}))
+	defer srv.Close()
+	cfg := readConfig(t, srv.URL, `
+aggregations:
+  http:
+    - name: orders
+      query: "uri: /orders"
+      variableValue: count
+      datasources:
+        - name: api
+`)
+	tests := []struct {
+		name   string
+		finish func(cancel context.CancelFunc)
+	}{
+		{name: "query finishes", finish: func(context.CancelFunc) { release <- struct{}{} }},
+		{name: "query cancelled", finish: func(cancel context.CancelFunc) { cancel() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var wg sync.WaitGroup
+			c, err := New("queryexporter", cfg, nil,
+				WithRegisterer(prometheus.NewRegistry()), WithContext(ctx), WithWaitGroup(&wg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			go c.Collect(make(chan prometheus.Metric, 10))
+			waitInflight(c.(*collector))
+			done := make(chan struct{})
+			go func() {
+				wg.Wait()
+				close(done)
+			}()
+			select {
+			case <-done:
+				t.Fatal("wait group is done while the collection is in flight")
+			case <-time.After(50 * time.Millisecond):
+			}
+			tt.finish(cancel)
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("wait group is not done after the collection")
+			}
+		})
+	}
+}
+
+func TestCircuitBreakersOfCollectors(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	metrics := `
+aggregations:
+  http:
+    - name: orders
+      query: "uri: /orders"
+      variableValue: count
+      datasources:
+        - name: api
+`
+	pc, err := New("queryexporter", readConfig(t, srv.URL, `
+    circuitBreaker:
+      failureThreshold: 1
+`+metrics), nil, WithRegisterer(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a collector without circuit breakers leaves the ones of others in place
+	if _, err = New("queryexporter", readConfig(t, srv.URL, metrics), nil, WithRegisterer(prometheus.NewRegistry())); err != nil {
+		t.Fatal(err)
+	}
+	c := pc.(*collector)
+	for range 3 {
+		scrapeOf(c, time.Time{})
+	}
+	if got := requests.Load(); got != 1 {
+		t.Fatalf("got %d requests, want 1 before the circuit breaker opens", got)
+	}
+}
@@ -4,17 +4,26 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 
 	"github.com/a8m/envsubst"
 	"github.com/creasty/defaults"
 	"sigs.k8s.io/yaml"
 
+	// drivers must be registered to validate queries at load
+	_ "github.com/fengxsong/queryexporter/pkg/querier"
+	"github.com/fengxsong/queryexporter/pkg/querier/factory"
 	"github.com/fengxsong/queryexporter/pkg/types"
 )
 
 type Config struct {
-	Servers      types.Servers                          `json:"servers"`
-	Aggregations map[types.DataSourceType]types.Metrics `json:"aggregations"`
+	Servers types.Servers `json:"servers"`
+	// Vars are available to query templates as .Vars
+	Vars map[string]any `json:"vars,omitempty"`
+	// MaxConcurrentQueries is the maximum number of in-flight queries against all servers,
+	// zero means unlimited
+	MaxConcurrentQueries int                                    `json:"maxConcurrentQueries,omitempty"`
+	Aggregations         map[types.DataSourceType]types.Metrics `json:"aggregations"`
 }
 
 func (c *Config) validateAndSetDefaults() error {
@@ -26,26 +35,66 @@ func (c *Config) validateAndSetDefaults() error {
 		if _, ok := servers[s.Name]; ok {
 			return fmt.Errorf("duplicate server %s", s.Name)
 		}
+		if s.MaxConcurrentQueries < 0 {
+			return fmt.Errorf("maxConcurrentQueries of server %s must not be negative", s.Name)
+		}
+		if s.RateLimit != nil {
+			if err := defaults.Set(s.RateLimit); err != nil {
+				return err
+			}
+			if err := s.RateLimit.Validate(); err != nil {
+				return fmt.Errorf("invalid rateLimit of server %s, err: %v", s.Name, err)
+			}
+		}
+		if s.CircuitBreaker != nil {
+			if err := defaults.Set(s.CircuitBreaker); err != nil {
+				return err
+			}
+			if err := s.CircuitBreaker.Validate(); err != nil {
+				return fmt.Errorf("invalid circuitBreaker of server %s, err: %v", s.Name, err)
+			}
+		}
+		if s.Retry != nil {
+			if err := defaults.Set(s.Retry); err != nil {
+				return err
+			}
+			if err := s.Retry.Validate(); err != nil {
+				return fmt.Errorf("invalid retry of server %s, err: %v", s.Name, err)
+			}
+		}
 		servers[s.Name] = s
 	}
+	if c.MaxConcurrentQueries < 0 {
+		return fmt.Errorf("maxConcurrentQueries must not be negative")
+	}
 
 	if err := defaults.Set(c); err != nil {
 		return err
 	}
 
-	setf := func(m *types.Metric) error {
-		for _, ds := range m.DataSources {
-			if _, ok := servers[ds.Name]; !ok {
-				return fmt.Errorf("unknown server %s", ds.Name)
+	for driver, metrics := range c.Aggregations {
+		setf := func(m *types.Metric) error {
+			for _, ds := range m.DataSources {
+				if _, ok := servers[ds.Name]; !ok {
+					return fmt.Errorf("unknown server %s", ds.Name)
+				}
+				// clients, limits and breakers are shared by all datasources of a server
+				if fields := ds.Server.ServerWideFields(); len(fields) > 0 {
+					return fmt.Errorf("%s must be set on server %s instead of its datasources", strings.Join(fields, ", "), ds.Name)
+				}
+				if ds.URI == "" {
+					ds.URI = servers[ds.Name].URI
+				}
+				ds.Pool = servers[ds.Name].Pool
+				ds.Retry = servers[ds.Name].Retry
 			}
-			if ds.URI == "" {
-				ds.URI = servers[ds.Name].URI
+			if err := m.Validate(); err != nil {
+				return err
 			}
+			// pre-parse template and driver-specific query syntax, so that errors
+			// are reported at startup instead of every scrape
+			return factory.Default.Validate(string(driver), m.DataSources, m.MetricDesc, c.Vars)
 		}
-		return m.Validate()
-	}
-
-	for _, metrics := range c.Aggregations {
 		if err := metrics.IterFn(setf); err != nil {
 			return err
 		}
@@ -84,3 +133,36 @@ func Dump(c *Config, w io.Writer) {
 		fmt.Fprintf(w, "%s", out)
 	}
 }
+
+// ConcurrencyLimits returns the global limit of in-flight queries, and limits of servers by name
+func (c *Config) ConcurrencyLimits() (int, map[string]int) {
+	servers := make(map[string]int, len(c.Servers))
+	for _, s := range c.Servers {
+		if s.MaxConcurrentQueries > 0 {
+			servers[s.Name] = s.MaxConcurrentQueries
+		}
+	}
+	return c.MaxConcurrentQueries, servers
+}
+
+// RateLimits returns rate limits of servers by name
+func (c *Config) RateLimits() map[string]*types.RateLimit {
+	limits := make(map[string]*types.RateLimit, len(c.Servers))
+	for _, s := range c.Servers {
+		if s.RateLimit != nil {
+			limits[s.Name] = s.RateLimit
+		}
+	}
+	return limits
+}
+
+// CircuitBreakers returns circuit breakers of servers by name
+func (c *Config) CircuitBreakers() map[string]*types.CircuitBreaker {
+	breakers := make(map[string]*types.CircuitBreaker, len(c.Servers))
+	for _, s := range c.Servers {
+		if s.CircuitBreaker != nil {
+			breakers[s.Name] = s.CircuitBreaker
+		}
+	}
+	return breakers
+}
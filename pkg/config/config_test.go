@@ -0,0 +1,267 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadFromFile(t *testing.T) {
+	const servers = `
+servers:
+  - name: cache
+    uri: redis://localhost:6379/0
+`
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{
+			name: "valid",
+			config: servers + `
+vars:
+  key: sessions
+aggregations:
+  redis:
+    - name: sessions
+      query: "GET {{ .Vars.key }}"
+      variableValue: value
+      datasources:
+        - name: cache
+`,
+		},
+		{
+			name: "unknown driver",
+			config: servers + `
+aggregations:
+  unknown:
+    - name: sessions
+      query: GET sessions
+      variableValue: value
+      datasources:
+        - name: cache
+`,
+			wantErr: "unknown",
+		},
+		{
+			name: "unknown server",
+			config: servers + `
+aggregations:
+  redis:
+    - name: sessions
+      query: GET sessions
+      variableValue: value
+      datasources:
+        - name: missing
+`,
+			wantErr: "unknown server missing",
+		},
+		{
+			name: "malformed template",
+			config: servers + `
+aggregations:
+  redis:
+    - name: sessions
+      query: "GET {{ .Vars.key "
+      variableValue: value
+      datasources:
+        - name: cache
+`,
+			wantErr: "failed to parse query of metric sessions",
+		},
+		{
+			name: "extra arguments of redis command",
+			config: servers + `
+aggregations:
+  redis:
+    - name: sessions
+      query: GET sessions extra
+      variableValue: value
+      datasources:
+        - name: cache
+`,
+			wantErr: "invalid query of metric sessions",
+		},
+		{
+			name: "rate limit of datasource",
+			config: servers + `
+aggregations:
+  redis:
+    - name: sessions
+      query: GET sessions
+      variableValue: value
+      datasources:
+        - name: cache
+          rateLimit:
+            queriesPerSecond: 1
+`,
+			wantErr: "must be set on server cache instead of its datasources",
+		},
+		{
+			name: "pool of datasource",
+			config: servers + `
+aggregations:
+  redis:
+    - name: sessions
+      query: GET sessions
+      variableValue: value
+      datasources:
+        - name: cache
+          pool:
+            maxOpen: 1
+`,
+			wantErr: "must be set on server cache instead of its datasources",
+		},
+		{
+			name: "concurrency limits",
+			config: `
+maxConcurrentQueries: 4
+servers:
+  - name: cache
+    uri: redis://localhost:6379/0
+    maxConcurrentQueries: 2
+`,
+		},
+		{
+			name: "negative concurrency limit of server",
+			config: `
+servers:
+  - name: cache
+    uri: redis://localhost:6379/0
+    maxConcurrentQueries: -1
+`,
+			wantErr: "maxConcurrentQueries of server cache must not be negative",
+		},
+		{
+			name: "rate limit",
+			config: `
+servers:
+  - name: cache
+    uri: redis://localhost:6379/0
+    rateLimit:
+      queriesPerSecond: 0.5
+`,
+		},
+		{
+			name: "unsupported rate limit policy",
+			config: `
+servers:
+  - name: cache
+    uri: redis://localhost:6379/0
+    rateLimit:
+      queriesPerSecond: 0.5
+      policy: drop
+`,
+			wantErr: "invalid rateLimit of server cache, err: unsupported policy drop",
+		},
+		{
+			name: "circuit breaker",
+			config: `
+servers:
+  - name: cache
+    uri: redis://localhost:6379/0
+    circuitBreaker: {}
+`,
+		},
+		{
+			name: "invalid circuit breaker",
+			config: `
+servers:
+  - name: cache
+    uri: redis://localhost:6379/0
+    circuitBreaker:
+      failureThreshold: -1
+`,
+			wantErr: "invalid circuitBreaker of server cache, err: failureThreshold must be at least 1",
+		},
+		{
+			name: "retry",
+			config: `
+servers:
+  - name: cache
+    uri: redis://localhost:6379/0
+    retry:
+      retryOn: [connection, timeout]
+`,
+		},
+		{
+			name: "unsupported retry class",
+			config: `
+servers:
+  - name: cache
+    uri: redis://localhost:6379/0
+    retry:
+      retryOn: [permanent]
+`,
+			wantErr: "invalid retry of server cache, err: unsupported error class permanent",
+		},
+		{
+			name: "negative concurrency limit",
+			config: servers + `
+maxConcurrentQueries: -1
+`,
+			wantErr: "maxConcurrentQueries must not be negative",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(fn, []byte(tt.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := ReadFromFile(fn, false)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDumpReload(t *testing.T) {
+	config := `
+servers:
+  - name: cache
+    uri: redis://localhost:6379/0
+    pool:
+      maxOpen: 2
+    retry:
+      attempts: 2
+aggregations:
+  redis:
+    - name: sessions
+      query: GET sessions
+      variableValue: value
+      datasources:
+        - name: cache
+`
+	fn := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(fn, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ReadFromFile(fn, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dumped bytes.Buffer
+	Dump(cfg, &dumped)
+	if err = os.WriteFile(fn, dumped.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err = ReadFromFile(fn, false); err != nil {
+		t.Fatalf("failed to read dumped config: %v\n%s", err, dumped.String())
+	}
+	// datasources take settings of their server without them being dumped
+	ds := cfg.Aggregations["redis"][0].DataSources[0]
+	if ds.Pool == nil || ds.Pool.MaxOpen != 2 || ds.Retry == nil || ds.Retry.Attempts != 2 {
+		t.Fatalf("got pool %+v and retry %+v of datasource, want the ones of server", ds.Pool, ds.Retry)
+	}
+}
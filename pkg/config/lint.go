@@ -0,0 +1,73 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+// Lint checks metric definitions against the Prometheus naming conventions, problems
+// are grouped by driver and then by metric name. Metrics without problems are absent.
+func (c *Config) Lint(namespace string) map[types.DataSourceType]map[string][]string {
+	problems := make(map[types.DataSourceType]map[string][]string)
+	for driver, metrics := range c.Aggregations {
+		for _, m := range metrics {
+			issues := lintMetric(namespace, string(driver), m.MetricDesc)
+			if len(issues) == 0 {
+				continue
+			}
+			if problems[driver] == nil {
+				problems[driver] = make(map[string][]string)
+			}
+			problems[driver][m.Name] = append(problems[driver][m.Name], issues...)
+		}
+	}
+	return problems
+}
+
+func lintMetric(namespace, driver string, m *types.MetricDesc) []string {
+	var issues []string
+	fqName := prometheus.BuildFQName(namespace, driver, m.Name)
+	if !model.IsValidLegacyMetricName(fqName) {
+		issues = append(issues, fmt.Sprintf("invalid metric name %q", fqName))
+	} else if strings.Contains(fqName, ":") {
+		issues = append(issues, fmt.Sprintf("metric name %q should not contain colons, they are reserved for recording rules", fqName))
+	}
+	if (m.Type == types.TypeGauge || m.Type == "") && strings.HasSuffix(fqName, "_total") {
+		issues = append(issues, fmt.Sprintf("gauge %q should not have suffix _total", fqName))
+	}
+
+	seen := make(map[string]string)
+	check := func(name, source string) {
+		if !model.LabelName(name).IsValidLegacy() {
+			issues = append(issues, fmt.Sprintf("invalid label name %q in %s", name, source))
+		} else if strings.HasPrefix(name, "__") {
+			issues = append(issues, fmt.Sprintf("label name %q in %s is reserved for internal use", name, source))
+		}
+		if prev, ok := seen[name]; ok {
+			issues = append(issues, fmt.Sprintf("duplicate label name %q in %s and %s", name, prev, source))
+			return
+		}
+		seen[name] = source
+	}
+	for _, name := range types.BuiltinLabels {
+		check(name, "builtin labels")
+	}
+	for _, name := range m.LabelNames() {
+		check(name, "variableLabels")
+	}
+	constLabels := make([]string, 0, len(m.ConstLabels))
+	for name := range m.ConstLabels {
+		constLabels = append(constLabels, name)
+	}
+	sort.Strings(constLabels)
+	for _, name := range constLabels {
+		check(name, "constLabels")
+	}
+	return issues
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+func TestLintMetric(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric types.MetricDesc
+		want   []string
+	}{
+		{
+			name:   "valid",
+			metric: types.MetricDesc{Name: "orders", VariableLabels: []string{"status"}},
+		},
+		{
+			name:   "invalid metric name",
+			metric: types.MetricDesc{Name: "orders-count"},
+			want:   []string{"invalid metric name"},
+		},
+		{
+			name:   "colons",
+			metric: types.MetricDesc{Name: "orders:rate"},
+			want:   []string{"should not contain colons"},
+		},
+		{
+			name:   "gauge with suffix total",
+			metric: types.MetricDesc{Name: "orders_total"},
+			want:   []string{"should not have suffix _total"},
+		},
+		{
+			name:   "reserved label name",
+			metric: types.MetricDesc{Name: "orders", ConstLabels: prometheus.Labels{"__env": "prod"}},
+			want:   []string{"reserved for internal use"},
+		},
+		{
+			name:   "duplicate of builtin label",
+			metric: types.MetricDesc{Name: "orders", VariableLabels: []string{"database"}},
+			want:   []string{`duplicate label name "database" in builtin labels and variableLabels`},
+		},
+		{
+			name:   "json path of variable label",
+			metric: types.MetricDesc{Name: "orders", VariableLabels: []string{"_id.status"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issues := lintMetric("queryexporter", "mysql", &tt.metric)
+			if len(issues) != len(tt.want) {
+				t.Fatalf("got issues %v, want %v", issues, tt.want)
+			}
+			for i := range tt.want {
+				if !strings.Contains(issues[i], tt.want[i]) {
+					t.Fatalf("got issue %q, want %q", issues[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package config
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/fengxsong/queryexporter/pkg/querier/factory"
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+const schemaDraft = "http://json-schema.org/draft-07/schema#"
+
+var (
+	durationType       = reflect.TypeOf(time.Duration(0))
+	modelDurationType  = reflect.TypeOf(model.Duration(0))
+	dataSourceTypeType = reflect.TypeOf(types.DataSourceType(""))
+)
+
+// schemaGenerator builds JSON Schema by reflecting on the json tags of config types,
+// named struct types are put into definitions and referenced by $ref.
+type schemaGenerator struct {
+	definitions map[string]any
+	drivers     []string
+}
+
+// enumerated is implemented by config types with fields restricted to a set of values,
+// Enums returns the values keyed by field name.
+type enumerated interface {
+	Enums() map[string][]string
+}
+
+// Schema generates JSON Schema of the config file. It is derived from the Go types
+// directly, so it stays in sync as fields are added. Enum values of drivers are taken
+// from the drivers registered in factory.Default.
+func Schema() map[string]any {
+	g := &schemaGenerator{
+		definitions: make(map[string]any),
+		drivers:     factory.Default.Drivers(),
+	}
+	root := g.structSchema(reflect.TypeOf(Config{}))
+	root["$schema"] = schemaDraft
+	root["title"] = "queryexporter config"
+	root["definitions"] = g.definitions
+	return root
+}
+
+func (g *schemaGenerator) typeSchema(t reflect.Type) map[string]any {
+	switch t {
+	case durationType:
+		return map[string]any{"type": "integer", "description": "duration in nanoseconds"}
+	case modelDurationType:
+		return map[string]any{"type": "string", "pattern": "^((\\d+)y)?((\\d+)w)?((\\d+)d)?((\\d+)h)?((\\d+)m)?((\\d+)s)?((\\d+)ms)?$"}
+	case dataSourceTypeType:
+		return g.driverSchema()
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.typeSchema(t.Elem())
+	case reflect.Struct:
+		name := t.Name()
+		if name == "" {
+			return g.structSchema(t)
+		}
+		if _, ok := g.definitions[name]; !ok {
+			// placeholder for recursive types
+			g.definitions[name] = nil
+			g.definitions[name] = g.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/definitions/" + name}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": g.typeSchema(t.Elem())}
+	case reflect.Map:
+		s := map[string]any{
+			"type":                 "object",
+			"additionalProperties": g.typeSchema(t.Elem()),
+		}
+		if t.Key() == dataSourceTypeType {
+			s["propertyNames"] = g.driverSchema()
+		}
+		return s
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	default:
+		return map[string]any{}
+	}
+}
+
+func (g *schemaGenerator) driverSchema() map[string]any {
+	return map[string]any{"type": "string", "enum": g.drivers}
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	g.collectProperties(t, properties, false)
+	return map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+// collectProperties walks fields of t, fields of inline or embedded structs are
+// flattened into properties of the parent, except server-wide fields of servers
+// inlined into datasources.
+func (g *schemaGenerator) collectProperties(t reflect.Type, properties map[string]any, inlined bool) {
+	var enums map[string][]string
+	if e, ok := reflect.New(t).Interface().(enumerated); ok {
+		enums = e.Enums()
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || inlined && f.Tag.Get("scope") == "server" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" || strings.Contains(opts, "inline") {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				g.collectProperties(ft, properties, true)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s := g.typeSchema(f.Type)
+		if values, ok := enums[f.Name]; ok {
+			// enums of lists apply to their items
+			if items, ok := s["items"].(map[string]any); ok {
+				items["enum"] = values
+			} else {
+				s["enum"] = values
+			}
+		}
+		if def, ok := f.Tag.Lookup("default"); ok {
+			s["default"] = defaultValue(s["type"], def)
+		}
+		properties[name] = s
+	}
+}
+
+// defaultValue converts value of the default tag into the json type of the schema
+func defaultValue(typ any, def string) any {
+	var (
+		v   any
+		err error
+	)
+	switch typ {
+	case "integer":
+		v, err = strconv.ParseInt(def, 10, 64)
+	case "number":
+		v, err = strconv.ParseFloat(def, 64)
+	case "boolean":
+		v, err = strconv.ParseBool(def)
+	default:
+		return def
+	}
+	if err != nil {
+		return def
+	}
+	return v
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSchema(t *testing.T) {
+	root := Schema()
+	definitions := root["definitions"].(map[string]any)
+	property := func(def, name string) map[string]any {
+		t.Helper()
+		s, ok := definitions[def].(map[string]any)
+		if !ok {
+			t.Fatalf("definition %s is missing", def)
+		}
+		p, ok := s["properties"].(map[string]any)[name].(map[string]any)
+		if !ok {
+			t.Fatalf("property %s of %s is missing", name, def)
+		}
+		return p
+	}
+
+	tests := []struct {
+		name string
+		got  func() any
+		want any
+	}{
+		{
+			name: "drivers of aggregations",
+			got: func() any {
+				return root["properties"].(map[string]any)["aggregations"].(map[string]any)["propertyNames"].(map[string]any)["enum"]
+			},
+			want: []string{"http", "mongo", "mysql", "postgres", "redis"},
+		},
+		{
+			name: "enum of metric type",
+			got:  func() any { return property("Metric", "type")["enum"] },
+			want: []string{"gauge"},
+		},
+		{
+			name: "default of metric type",
+			got:  func() any { return property("Metric", "type")["default"] },
+			want: "gauge",
+		},
+		{
+			name: "integer default of burst",
+			got:  func() any { return property("RateLimit", "burst")["default"] },
+			want: int64(1),
+		},
+		{
+			name: "enum of rate limit policy",
+			got:  func() any { return property("RateLimit", "policy")["enum"] },
+			want: []string{"wait", "lastResult"},
+		},
+		{
+			name: "enum of retry classes applies to items",
+			got:  func() any { return property("RetryPolicy", "retryOn")["items"].(map[string]any)["enum"] },
+			want: []string{"connection", "timeout", "unavailable", "throttled"},
+		},
+		{
+			name: "inline server fields of datasources",
+			got:  func() any { return property("DataSource", "uri")["type"] },
+			want: "string",
+		},
+		{
+			name: "server-wide fields are omitted from datasources",
+			got: func() any {
+				_, ok := definitions["DataSource"].(map[string]any)["properties"].(map[string]any)["rateLimit"]
+				return ok
+			},
+			want: false,
+		},
+		{
+			name: "server-wide fields of servers",
+			got:  func() any { return property("Server", "rateLimit")["$ref"] },
+			want: "#/definitions/RateLimit",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.got(); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
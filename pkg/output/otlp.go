@@ -0,0 +1,342 @@
+package output
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+const (
+	otlpScopeName = "github.com/fengxsong/queryexporter"
+	// AGGREGATION_TEMPORALITY_CUMULATIVE
+	otlpCumulative = 2
+)
+
+// resource attributes the builtin labels name/database/table are mapped to
+var otlpResourceAttributes = map[string]string{
+	types.BuiltinLabels[0]: "queryexporter.server",
+	types.BuiltinLabels[1]: "db.namespace",
+	types.BuiltinLabels[2]: "db.collection.name",
+}
+
+// OTLP sends metrics to an OpenTelemetry collector using OTLP/HTTP with JSON encoding.
+// Server and datasource become resource attributes, other labels like variableLabels
+// and constLabels become data point attributes.
+type OTLP struct {
+	url     string
+	service string
+	headers map[string]string
+	client  *http.Client
+	// modules maps fully-qualified metric names to modules
+	modules map[string]string
+	// start is the start time of cumulative points without a created timestamp
+	start time.Time
+}
+
+func NewOTLP(url, service string, headers map[string]string, timeout time.Duration, modules map[string]string) *OTLP {
+	return &OTLP{
+		url:     url,
+		service: service,
+		headers: headers,
+		client:  &http.Client{Timeout: timeout},
+		modules: modules,
+		start:   time.Now(),
+	}
+}
+
+// messages of OTLP metrics, only fields that are used are defined
+type (
+	otlpRequest struct {
+		ResourceMetrics []*otlpResourceMetrics `json:"resourceMetrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource     otlpResource        `json:"resource"`
+		ScopeMetrics []*otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeMetrics struct {
+		Scope   otlpScope     `json:"scope"`
+		Metrics []*otlpMetric `json:"metrics"`
+	}
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string        `json:"key"`
+		Value otlpAnyString `json:"value"`
+	}
+	otlpAnyString struct {
+		StringValue string `json:"stringValue"`
+	}
+	otlpMetric struct {
+		Name        string         `json:"name"`
+		Description string         `json:"description,omitempty"`
+		Gauge       *otlpGauge     `json:"gauge,omitempty"`
+		Sum         *otlpSum       `json:"sum,omitempty"`
+		Histogram   *otlpHistogram `json:"histogram,omitempty"`
+		Summary     *otlpSummary   `json:"summary,omitempty"`
+	}
+	otlpGauge struct {
+		DataPoints []*otlpNumberDataPoint `json:"dataPoints"`
+	}
+	otlpSum struct {
+		DataPoints             []*otlpNumberDataPoint `json:"dataPoints"`
+		AggregationTemporality int                    `json:"aggregationTemporality"`
+		IsMonotonic            bool                   `json:"isMonotonic"`
+	}
+	otlpHistogram struct {
+		DataPoints             []*otlpHistogramDataPoint `json:"dataPoints"`
+		AggregationTemporality int                       `json:"aggregationTemporality"`
+	}
+	otlpSummary struct {
+		DataPoints []*otlpSummaryDataPoint `json:"dataPoints"`
+	}
+	otlpNumberDataPoint struct {
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano,omitempty"`
+		TimeUnixNano      string         `json:"timeUnixNano"`
+		AsDouble          otlpDouble     `json:"asDouble"`
+	}
+	otlpHistogramDataPoint struct {
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano,omitempty"`
+		TimeUnixNano      string         `json:"timeUnixNano"`
+		Count             string         `json:"count"`
+		Sum               otlpDouble     `json:"sum"`
+		BucketCounts      []string       `json:"bucketCounts"`
+		ExplicitBounds    []otlpDouble   `json:"explicitBounds"`
+	}
+	otlpSummaryDataPoint struct {
+		Attributes        []otlpKeyValue      `json:"attributes,omitempty"`
+		StartTimeUnixNano string              `json:"startTimeUnixNano,omitempty"`
+		TimeUnixNano      string              `json:"timeUnixNano"`
+		Count             string              `json:"count"`
+		Sum               otlpDouble          `json:"sum"`
+		QuantileValues    []otlpQuantileValue `json:"quantileValues"`
+	}
+	otlpQuantileValue struct {
+		Quantile otlpDouble `json:"quantile"`
+		Value    otlpDouble `json:"value"`
+	}
+)
+
+// otlpDouble encodes NaN and infinities as strings like protojson does,
+// which are rejected by encoding/json otherwise.
+type otlpDouble float64
+
+func (d otlpDouble) MarshalJSON() ([]byte, error) {
+	f := float64(d)
+	switch {
+	case math.IsNaN(f):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(f, 1):
+		return []byte(`"Infinity"`), nil
+	case math.IsInf(f, -1):
+		return []byte(`"-Infinity"`), nil
+	}
+	return json.Marshal(f)
+}
+
+func (o *OTLP) Export(ctx context.Context, g prometheus.Gatherer) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(o.convert(mfs, time.Now()))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for k, v := range o.headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "queryexporter/"+version.Version)
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// convert groups metrics into resources by the module and builtin labels, now is used
+// as timestamp of metrics that don't carry a timestamp.
+func (o *OTLP) convert(mfs []*dto.MetricFamily, now time.Time) *otlpRequest {
+	var (
+		req       = &otlpRequest{}
+		resources = make(map[string]*otlpScopeMetrics)
+	)
+	scopeOf := func(attrs []otlpKeyValue) *otlpScopeMetrics {
+		parts := make([]string, len(attrs))
+		for i := range attrs {
+			parts[i] = attrs[i].Key + "=" + attrs[i].Value.StringValue
+		}
+		key := strings.Join(parts, ",")
+		sm, ok := resources[key]
+		if !ok {
+			sm = &otlpScopeMetrics{Scope: otlpScope{Name: otlpScopeName, Version: version.Version}}
+			resources[key] = sm
+			req.ResourceMetrics = append(req.ResourceMetrics, &otlpResourceMetrics{
+				Resource:     otlpResource{Attributes: attrs},
+				ScopeMetrics: []*otlpScopeMetrics{sm},
+			})
+		}
+		return sm
+	}
+
+	for _, mf := range mfs {
+		module := o.modules[mf.GetName()]
+		// one metric of every resource per metric family
+		metrics := make(map[*otlpScopeMetrics]*otlpMetric)
+		for _, m := range mf.Metric {
+			resourceAttrs, attrs := o.splitAttributes(module, m)
+			sm := scopeOf(resourceAttrs)
+			metric, ok := metrics[sm]
+			if !ok {
+				metric = newOTLPMetric(mf)
+				metrics[sm] = metric
+				sm.Metrics = append(sm.Metrics, metric)
+			}
+			ts := now.UnixNano()
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs() * int64(time.Millisecond)
+			}
+			appendDataPoint(metric, mf.GetType(), m, attrs, strconv.FormatInt(o.startOf(m), 10), strconv.FormatInt(ts, 10))
+		}
+	}
+	return req
+}
+
+// startOf returns the start time of cumulative points in unix nanoseconds, metrics of
+// client_golang carry their created timestamps, others like the ones produced by queries
+// start when the exporter started.
+func (o *OTLP) startOf(m *dto.Metric) int64 {
+	var created *timestamppb.Timestamp
+	switch {
+	case m.Counter != nil:
+		created = m.Counter.CreatedTimestamp
+	case m.Histogram != nil:
+		created = m.Histogram.CreatedTimestamp
+	case m.Summary != nil:
+		created = m.Summary.CreatedTimestamp
+	}
+	if created.IsValid() {
+		return created.AsTime().UnixNano()
+	}
+	return o.start.UnixNano()
+}
+
+func (o *OTLP) splitAttributes(module string, m *dto.Metric) ([]otlpKeyValue, []otlpKeyValue) {
+	resourceAttrs := []otlpKeyValue{{Key: "service.name", Value: otlpAnyString{o.service}}}
+	var attrs []otlpKeyValue
+	// only metrics from queries carry builtin labels, self-metrics keep all their labels
+	if module != "" {
+		resourceAttrs = append(resourceAttrs, otlpKeyValue{Key: "queryexporter.driver", Value: otlpAnyString{module}})
+	}
+	for _, lp := range m.Label {
+		if key, ok := otlpResourceAttributes[lp.GetName()]; ok && module != "" {
+			if lp.GetValue() != "" {
+				resourceAttrs = append(resourceAttrs, otlpKeyValue{Key: key, Value: otlpAnyString{lp.GetValue()}})
+			}
+			continue
+		}
+		attrs = append(attrs, otlpKeyValue{Key: lp.GetName(), Value: otlpAnyString{lp.GetValue()}})
+	}
+	sort.Slice(resourceAttrs, func(i, j int) bool { return resourceAttrs[i].Key < resourceAttrs[j].Key })
+	return resourceAttrs, attrs
+}
+
+func newOTLPMetric(mf *dto.MetricFamily) *otlpMetric {
+	metric := &otlpMetric{Name: mf.GetName(), Description: mf.GetHelp()}
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		metric.Sum = &otlpSum{AggregationTemporality: otlpCumulative, IsMonotonic: true}
+	case dto.MetricType_HISTOGRAM:
+		metric.Histogram = &otlpHistogram{AggregationTemporality: otlpCumulative}
+	case dto.MetricType_SUMMARY:
+		metric.Summary = &otlpSummary{}
+	default:
+		metric.Gauge = &otlpGauge{}
+	}
+	return metric
+}
+
+// appendDataPoint appends m to metric, start is only set on points of cumulative metrics
+func appendDataPoint(metric *otlpMetric, typ dto.MetricType, m *dto.Metric, attrs []otlpKeyValue, start, ts string) {
+	switch typ {
+	case dto.MetricType_COUNTER:
+		metric.Sum.DataPoints = append(metric.Sum.DataPoints, &otlpNumberDataPoint{
+			Attributes: attrs, StartTimeUnixNano: start, TimeUnixNano: ts, AsDouble: otlpDouble(m.GetCounter().GetValue()),
+		})
+	case dto.MetricType_HISTOGRAM:
+		h := m.GetHistogram()
+		dp := &otlpHistogramDataPoint{
+			Attributes:        attrs,
+			StartTimeUnixNano: start,
+			TimeUnixNano:      ts,
+			Count:             strconv.FormatUint(h.GetSampleCount(), 10),
+			Sum:               otlpDouble(h.GetSampleSum()),
+		}
+		// OTLP buckets are not cumulative and have an implicit +Inf bucket
+		var prev uint64
+		for _, b := range h.Bucket {
+			if math.IsInf(b.GetUpperBound(), 1) {
+				continue
+			}
+			dp.ExplicitBounds = append(dp.ExplicitBounds, otlpDouble(b.GetUpperBound()))
+			dp.BucketCounts = append(dp.BucketCounts, strconv.FormatUint(b.GetCumulativeCount()-prev, 10))
+			prev = b.GetCumulativeCount()
+		}
+		dp.BucketCounts = append(dp.BucketCounts, strconv.FormatUint(h.GetSampleCount()-prev, 10))
+		metric.Histogram.DataPoints = append(metric.Histogram.DataPoints, dp)
+	case dto.MetricType_SUMMARY:
+		s := m.GetSummary()
+		dp := &otlpSummaryDataPoint{
+			Attributes:        attrs,
+			StartTimeUnixNano: start,
+			TimeUnixNano:      ts,
+			Count:             strconv.FormatUint(s.GetSampleCount(), 10),
+			Sum:               otlpDouble(s.GetSampleSum()),
+		}
+		for _, q := range s.Quantile {
+			dp.QuantileValues = append(dp.QuantileValues, otlpQuantileValue{Quantile: otlpDouble(q.GetQuantile()), Value: otlpDouble(q.GetValue())})
+		}
+		metric.Summary.DataPoints = append(metric.Summary.DataPoints, dp)
+	case dto.MetricType_GAUGE:
+		metric.Gauge.DataPoints = append(metric.Gauge.DataPoints, &otlpNumberDataPoint{
+			Attributes: attrs, TimeUnixNano: ts, AsDouble: otlpDouble(m.GetGauge().GetValue()),
+		})
+	default:
+		metric.Gauge.DataPoints = append(metric.Gauge.DataPoints, &otlpNumberDataPoint{
+			Attributes: attrs, TimeUnixNano: ts, AsDouble: otlpDouble(m.GetUntyped().GetValue()),
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package output
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestOTLPExport(t *testing.T) {
+	var received map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected content type %s", r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("failed to decode request, err: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	before := time.Now()
+	orders := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_mysql_orders", Help: "Orders."}, []string{"name", "database", "table", "status"})
+	orders.WithLabelValues("primary", "shop", "", "paid").Set(3)
+	scrapes := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_scrapes_total", Help: "Scrapes."})
+	scrapes.Add(2)
+	created := time.Now()
+	duration := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_duration_seconds", Help: "Duration.", Buckets: []float64{1}})
+	duration.Observe(0.5)
+	duration.Observe(2)
+	// without created timestamp
+	rows := prometheus.NewCounterFunc(prometheus.CounterOpts{Name: "test_rows_total", Help: "Rows."}, func() float64 { return 7 })
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(orders, scrapes, duration, rows)
+
+	e := NewOTLP(srv.URL, "test", nil, 5*time.Second, map[string]string{"test_mysql_orders": "mysql"})
+	if err := e.Export(context.Background(), reg); err != nil {
+		t.Fatal(err)
+	}
+
+	// points of metrics by name, and attributes of their resources
+	points := make(map[string]map[string]any)
+	resources := make(map[string]map[string]string)
+	for _, rm := range received["resourceMetrics"].([]any) {
+		rm := rm.(map[string]any)
+		attrs := make(map[string]string)
+		for _, kv := range rm["resource"].(map[string]any)["attributes"].([]any) {
+			kv := kv.(map[string]any)
+			attrs[kv["key"].(string)] = kv["value"].(map[string]any)["stringValue"].(string)
+		}
+		for _, sm := range rm["scopeMetrics"].([]any) {
+			for _, m := range sm.(map[string]any)["metrics"].([]any) {
+				m := m.(map[string]any)
+				name := m["name"].(string)
+				resources[name] = attrs
+				for _, kind := range []string{"gauge", "sum", "histogram"} {
+					if data, ok := m[kind].(map[string]any); ok {
+						points[name] = data["dataPoints"].([]any)[0].(map[string]any)
+						points[name]["kind"] = kind
+					}
+				}
+			}
+		}
+	}
+	nanos := func(v any) int64 {
+		n, _ := strconv.ParseInt(v.(string), 10, 64)
+		return n
+	}
+
+	tests := []struct {
+		metric    string
+		kind      string
+		resource  map[string]string
+		wantStart func(start int64) bool
+	}{
+		{
+			metric:    "test_mysql_orders",
+			kind:      "gauge",
+			resource:  map[string]string{"service.name": "test", "queryexporter.driver": "mysql", "queryexporter.server": "primary", "db.namespace": "shop"},
+			wantStart: func(start int64) bool { return start == 0 },
+		},
+		{
+			metric:    "test_scrapes_total",
+			kind:      "sum",
+			resource:  map[string]string{"service.name": "test"},
+			wantStart: func(start int64) bool { return start >= before.UnixNano() && start <= created.UnixNano() },
+		},
+		{
+			metric:    "test_duration_seconds",
+			kind:      "histogram",
+			resource:  map[string]string{"service.name": "test"},
+			wantStart: func(start int64) bool { return start >= created.UnixNano() && start <= e.start.UnixNano() },
+		},
+		{
+			metric:    "test_rows_total",
+			kind:      "sum",
+			resource:  map[string]string{"service.name": "test"},
+			wantStart: func(start int64) bool { return start == e.start.UnixNano() },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.metric, func(t *testing.T) {
+			dp, ok := points[tt.metric]
+			if !ok {
+				t.Fatalf("metric %s is missing", tt.metric)
+			}
+			if dp["kind"] != tt.kind {
+				t.Fatalf("got kind %s, want %s", dp["kind"], tt.kind)
+			}
+			for k, v := range tt.resource {
+				if resources[tt.metric][k] != v {
+					t.Fatalf("got resource attributes %v, want %s=%s", resources[tt.metric], k, v)
+				}
+			}
+			var start int64
+			if v, ok := dp["startTimeUnixNano"]; ok {
+				start = nanos(v)
+			}
+			if !tt.wantStart(start) {
+				t.Fatalf("unexpected start time %d", start)
+			}
+			if ts := nanos(dp["timeUnixNano"]); start > ts {
+				t.Fatalf("start time %d is after time %d", start, ts)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package output
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Exporter sends metrics gathered from g to a destination other than the pull-based
+// /metrics handler.
+type Exporter interface {
+	Export(ctx context.Context, g prometheus.Gatherer) error
+}
+
+// Flusher is implemented by exporters sending metrics in background, Flush waits
+// until metrics of previous exports are sent.
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// finalFlushTimeout bounds sending metrics still queued by exporters once ctx is done
+const finalFlushTimeout = 5 * time.Second
+
+// Run exports once if interval is zero, otherwise it exports every interval until ctx is done.
+// In loop mode errors are logged rather than returned, so that a failed round does not stop
+// the following ones, and metrics still queued once ctx is done are flushed a last time.
+func Run(ctx context.Context, logger *slog.Logger, g prometheus.Gatherer, e Exporter, interval time.Duration) error {
+	if interval <= 0 {
+		if err := e.Export(ctx, g); err != nil {
+			return err
+		}
+		if f, ok := e.(Flusher); ok {
+			return f.Flush(ctx)
+		}
+		return nil
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		if err := e.Export(ctx, g); err != nil {
+			logger.Error("failed to export metrics", "err", err)
+		} else {
+			logger.Debug("exported metrics", "duration", time.Since(start))
+		}
+		select {
+		case <-ctx.Done():
+			if f, ok := e.(Flusher); ok {
+				flushCtx, cancel := context.WithTimeout(context.Background(), finalFlushTimeout)
+				defer cancel()
+				if err := f.Flush(flushCtx); err != nil {
+					logger.Error("failed to flush metrics", "err", err)
+				}
+			}
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package output
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/multierr"
+
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+const (
+	groupingServer = "server"
+	groupingModule = "module"
+)
+
+// Pushgateway pushes metrics to a Prometheus Pushgateway. Metrics are split into groups
+// by the server they are queried from and the module(driver) they belong to, every group
+// is replaced as a whole on each push. Groups pushed before but absent from the current push,
+// e.g. of a server whose queries failed, are deleted so that stale values don't linger.
+type Pushgateway struct {
+	url string
+	job string
+	// modules maps fully-qualified metric names to modules
+	modules map[string]string
+
+	mu sync.Mutex
+	// pushed holds groups pushed by previous exports which are not deleted yet
+	pushed map[groupKey]struct{}
+}
+
+func NewPushgateway(url, job string, modules map[string]string) *Pushgateway {
+	return &Pushgateway{url: url, job: job, modules: modules}
+}
+
+type groupKey struct {
+	server string
+	module string
+}
+
+func (p *Pushgateway) Export(ctx context.Context, g prometheus.Gatherer) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return err
+	}
+	groups := p.split(mfs)
+	keys := make([]groupKey, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].server != keys[j].server {
+			return keys[i].server < keys[j].server
+		}
+		return keys[i].module < keys[j].module
+	})
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var errs []error
+	for _, key := range keys {
+		if err = p.pusher(key).Gatherer(gathered(groups[key])).PushContext(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	pushed := make(map[groupKey]struct{}, len(groups))
+	for key := range groups {
+		pushed[key] = struct{}{}
+	}
+	for key := range p.pushed {
+		if _, ok := groups[key]; ok {
+			continue
+		}
+		if err = p.pusher(key).Delete(); err != nil {
+			// deleted again on the next export
+			pushed[key] = struct{}{}
+			errs = append(errs, err)
+		}
+	}
+	p.pushed = pushed
+	return multierr.Combine(errs...)
+}
+
+func (p *Pushgateway) pusher(key groupKey) *push.Pusher {
+	pusher := push.New(p.url, p.job)
+	if key.server != "" {
+		pusher = pusher.Grouping(groupingServer, key.server)
+	}
+	if key.module != "" {
+		pusher = pusher.Grouping(groupingModule, key.module)
+	}
+	return pusher
+}
+
+// split groups metrics by server and module, metrics without the server label,
+// like the self-metrics, are put into the group of the job only.
+func (p *Pushgateway) split(mfs []*dto.MetricFamily) map[groupKey][]*dto.MetricFamily {
+	groups := make(map[groupKey][]*dto.MetricFamily)
+	for _, mf := range mfs {
+		module := p.modules[mf.GetName()]
+		subsets := make(map[groupKey]*dto.MetricFamily)
+		for _, m := range mf.Metric {
+			key := groupKey{module: module}
+			if module != "" {
+				key.server = labelValue(m, types.BuiltinLabels[0])
+			}
+			subset, ok := subsets[key]
+			if !ok {
+				subset = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type}
+				subsets[key] = subset
+				groups[key] = append(groups[key], subset)
+			}
+			subset.Metric = append(subset.Metric, m)
+		}
+	}
+	return groups
+}
+
+func labelValue(m *dto.Metric, name string) string {
+	for _, lp := range m.Label {
+		if lp.GetName() == name {
+			return lp.GetValue()
+		}
+	}
+	return ""
+}
+
+// gathered returns a Gatherer that always returns mfs
+func gathered(mfs []*dto.MetricFamily) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return mfs, nil
+	})
+}
@@ -0,0 +1,96 @@
+package output
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPushgatewayExport(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+groupingOf(r.URL.Path))
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	orders := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_mysql_orders", Help: "Orders."}, []string{"name"})
+	scrapes := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_scrapes_total", Help: "Scrapes."})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(orders, scrapes)
+	p := NewPushgateway(srv.URL, "test", map[string]string{"test_mysql_orders": "mysql"})
+
+	tests := []struct {
+		name    string
+		servers []string
+		want    []string
+	}{
+		{
+			name:    "groups by server",
+			servers: []string{"primary", "replica"},
+			want: []string{
+				"PUT /metrics/job/test",
+				"PUT /metrics/job/test/module/mysql/server/primary",
+				"PUT /metrics/job/test/module/mysql/server/replica",
+			},
+		},
+		{
+			name:    "deletes groups absent from the push",
+			servers: []string{"primary"},
+			want: []string{
+				"DELETE /metrics/job/test/module/mysql/server/replica",
+				"PUT /metrics/job/test",
+				"PUT /metrics/job/test/module/mysql/server/primary",
+			},
+		},
+		{
+			name:    "deletes groups once",
+			servers: []string{"primary"},
+			want: []string{
+				"PUT /metrics/job/test",
+				"PUT /metrics/job/test/module/mysql/server/primary",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orders.Reset()
+			for _, server := range tt.servers {
+				orders.WithLabelValues(server).Set(1)
+			}
+			requests = nil
+			if err := p.Export(context.Background(), reg); err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(requests)
+			if !reflect.DeepEqual(requests, tt.want) {
+				t.Fatalf("got requests %v, want %v", requests, tt.want)
+			}
+		})
+	}
+}
+
+// groupingOf sorts labels of the grouping key in path, the order of labels
+// is random in requests of the pusher
+func groupingOf(p string) string {
+	parts := strings.Split(strings.TrimPrefix(p, "/metrics/job/test"), "/")[1:]
+	pairs := make([]string, 0, len(parts)/2)
+	for i := 0; i+1 < len(parts); i += 2 {
+		pairs = append(pairs, parts[i]+"/"+parts[i+1])
+	}
+	sort.Strings(pairs)
+	return path.Join(append([]string{"/metrics/job/test"}, pairs...)...)
+}
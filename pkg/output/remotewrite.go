@@ -0,0 +1,370 @@
+package output
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/version"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// RemoteWriteOptions configures batching, queueing and retrying of RemoteWrite
+type RemoteWriteOptions struct {
+	// BatchSize is the maximum number of samples per request
+	BatchSize int
+	// QueueCapacity is the maximum number of samples kept in memory while the
+	// receiver is unavailable, the oldest samples are dropped when it is exceeded
+	QueueCapacity int
+	// MaxRetries of every request on recoverable errors
+	MaxRetries int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	Timeout    time.Duration
+	Headers    map[string]string
+}
+
+// RemoteWrite sends samples to a receiver using the Prometheus remote write 1.0 protocol.
+// Samples are kept in an in-memory queue without WAL and sent by a background sender,
+// so that exports never wait on the receiver. Failed batches stay in the queue and are
+// retried once more samples are queued.
+type RemoteWrite struct {
+	url    string
+	opts   RemoteWriteOptions
+	client *http.Client
+	logger *slog.Logger
+
+	once    sync.Once
+	wake    chan struct{}
+	flushes chan flushRequest
+	// stopped is closed once the sender stops, samples left are sent by Flush then
+	stopped chan struct{}
+	sendMu  sync.Mutex
+
+	mu    sync.Mutex
+	queue []timeSeries
+	// head is the number of samples ever removed from the front of queue, either sent
+	// or dropped, it tells which samples of an in-flight batch are still queued
+	head int
+
+	// lastErr is the error of the last flush and lastErrAt the number of samples ever
+	// queued when it failed, they are only accessed by the sender
+	lastErr   error
+	lastErrAt int
+}
+
+func NewRemoteWrite(logger *slog.Logger, url string, opts RemoteWriteOptions) *RemoteWrite {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 2000
+	}
+	if opts.QueueCapacity < opts.BatchSize {
+		opts.QueueCapacity = opts.BatchSize
+	}
+	return &RemoteWrite{
+		url:     url,
+		opts:    opts,
+		client:  &http.Client{Timeout: opts.Timeout},
+		logger:  logger,
+		wake:    make(chan struct{}, 1),
+		flushes: make(chan flushRequest),
+		stopped: make(chan struct{}),
+	}
+}
+
+// flushRequest asks the sender to send queued samples until ctx is done, the
+// result is sent to done
+type flushRequest struct {
+	ctx  context.Context
+	done chan error
+}
+
+type label struct {
+	name, value string
+}
+
+type timeSeries struct {
+	labels    []label
+	value     float64
+	timestamp int64
+}
+
+// Export queues samples and wakes the sender, which is started on the first export
+// and stops once ctx is done.
+func (r *RemoteWrite) Export(ctx context.Context, g prometheus.Gatherer) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return err
+	}
+	r.once.Do(func() { go r.run(ctx) })
+
+	r.mu.Lock()
+	r.queue = append(r.queue, toTimeSeries(mfs, time.Now())...)
+	if dropped := len(r.queue) - r.opts.QueueCapacity; dropped > 0 {
+		r.logger.Warn("remote write queue is full, dropping oldest samples", "dropped", dropped)
+		r.remove(dropped)
+	}
+	r.mu.Unlock()
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Flush waits until the sender sent every queued sample, it returns the error of the
+// first batch that couldn't be sent. Once the sender stopped, e.g. on termination,
+// queued samples are sent by the caller until ctx is done.
+func (r *RemoteWrite) Flush(ctx context.Context) error {
+	r.once.Do(func() { go r.run(ctx) })
+	done := make(chan error, 1)
+	select {
+	case r.flushes <- flushRequest{ctx: ctx, done: done}:
+	case <-r.stopped:
+		r.sendMu.Lock()
+		defer r.sendMu.Unlock()
+		return r.flush(ctx)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *RemoteWrite) run(ctx context.Context) {
+	defer close(r.stopped)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.wake:
+			if err := r.flush(ctx); err != nil {
+				r.logger.Error("failed to send samples", "err", err)
+			}
+		case req := <-r.flushes:
+			// samples of a pending wake up are sent by this flush as well
+			select {
+			case <-r.wake:
+			default:
+			}
+			// nothing is queued since the last flush failed, don't send the same
+			// samples again
+			r.mu.Lock()
+			queued := r.head + len(r.queue)
+			r.mu.Unlock()
+			if r.lastErr != nil && r.lastErrAt == queued {
+				req.done <- r.lastErr
+				continue
+			}
+			req.done <- r.flush(req.ctx)
+		}
+	}
+}
+
+// flush sends queued samples in batches until the queue is empty. The queue is not
+// locked while sending, samples of a batch may be dropped by exports meanwhile.
+func (r *RemoteWrite) flush(ctx context.Context) error {
+	for {
+		r.mu.Lock()
+		n := min(len(r.queue), r.opts.BatchSize)
+		if n == 0 {
+			r.mu.Unlock()
+			r.lastErr = nil
+			return nil
+		}
+		batch := append([]timeSeries(nil), r.queue[:n]...)
+		end := r.head + n
+		r.mu.Unlock()
+
+		err := r.sendWithRetries(ctx, batch)
+		var nonRecoverable *nonRecoverableError
+		if errors.As(err, &nonRecoverable) {
+			r.logger.Error("dropping samples rejected by receiver", "count", n, "err", err)
+		} else if err != nil {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			err = fmt.Errorf("%d samples remain queued, err: %w", len(r.queue), err)
+			// samples are sent again by the next flush if the sender was only stopping
+			r.lastErr, r.lastErrAt = nil, 0
+			if ctx.Err() == nil {
+				r.lastErr, r.lastErrAt = err, r.head+len(r.queue)
+			}
+			return err
+		}
+		r.mu.Lock()
+		if sent := end - r.head; sent > 0 {
+			r.remove(sent)
+		}
+		r.mu.Unlock()
+	}
+}
+
+// remove removes n samples from the front of queue, r.mu must be held
+func (r *RemoteWrite) remove(n int) {
+	r.queue = append(r.queue[:0], r.queue[n:]...)
+	r.head += n
+}
+
+type nonRecoverableError struct {
+	error
+}
+
+func (r *RemoteWrite) sendWithRetries(ctx context.Context, batch []timeSeries) error {
+	data := snappy.Encode(nil, encodeWriteRequest(batch))
+	backoff := r.opts.MinBackoff
+	for attempt := 0; ; attempt++ {
+		err := r.send(ctx, data)
+		var nonRecoverable *nonRecoverableError
+		if err == nil || errors.As(err, &nonRecoverable) || attempt >= r.opts.MaxRetries {
+			return err
+		}
+		r.logger.Debug("failed to send samples, retrying", "attempt", attempt+1, "backoff", backoff, "err", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, r.opts.MaxBackoff)
+	}
+}
+
+func (r *RemoteWrite) send(ctx context.Context, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(data))
+	if err != nil {
+		return &nonRecoverableError{err}
+	}
+	for k, v := range r.opts.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "queryexporter/"+version.Version)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+	err = fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(body))
+	// same as prometheus, 5xx and 429 are recoverable
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return err
+	}
+	return &nonRecoverableError{err}
+}
+
+// toTimeSeries flattens metric families into samples, now is used as timestamp
+// of metrics that don't carry a timestamp.
+func toTimeSeries(mfs []*dto.MetricFamily, now time.Time) []timeSeries {
+	var series []timeSeries
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.Metric {
+			ts := now.UnixMilli()
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs()
+			}
+			add := func(name string, value float64, extra ...label) {
+				labels := make([]label, 0, len(m.Label)+len(extra)+1)
+				labels = append(labels, label{model.MetricNameLabel, name})
+				for _, lp := range m.Label {
+					// empty labels are equivalent to absent ones in prometheus
+					if lp.GetValue() == "" {
+						continue
+					}
+					labels = append(labels, label{lp.GetName(), lp.GetValue()})
+				}
+				labels = append(labels, extra...)
+				sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+				series = append(series, timeSeries{labels: labels, value: value, timestamp: ts})
+			}
+			switch mf.GetType() {
+			case dto.MetricType_GAUGE:
+				add(name, m.GetGauge().GetValue())
+			case dto.MetricType_COUNTER:
+				add(name, m.GetCounter().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.Quantile {
+					add(name, q.GetValue(), label{model.QuantileLabel, formatFloat(q.GetQuantile())})
+				}
+				add(name+"_sum", s.GetSampleSum())
+				add(name+"_count", float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.Bucket {
+					add(name+"_bucket", float64(b.GetCumulativeCount()), label{model.BucketLabel, formatFloat(b.GetUpperBound())})
+				}
+				add(name+"_bucket", float64(h.GetSampleCount()), label{model.BucketLabel, "+Inf"})
+				add(name+"_sum", h.GetSampleSum())
+				add(name+"_count", float64(h.GetSampleCount()))
+			}
+		}
+	}
+	return series
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// encodeWriteRequest encodes series as prometheus.WriteRequest protobuf message:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(series []timeSeries) []byte {
+	var buf, ts, msg []byte
+	for _, s := range series {
+		ts = ts[:0]
+		for _, l := range s.labels {
+			msg = msg[:0]
+			msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.name)
+			msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, msg)
+		}
+		msg = msg[:0]
+		msg = protowire.AppendTag(msg, 1, protowire.Fixed64Type)
+		msg = protowire.AppendFixed64(msg, math.Float64bits(s.value))
+		msg = protowire.AppendTag(msg, 2, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, uint64(s.timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, msg)
+
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, ts)
+	}
+	return buf
+}
@@ -0,0 +1,214 @@
+package output
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// timestamped is a collector of a single gauge carrying timestamp ts
+type timestamped struct {
+	desc  *prometheus.Desc
+	value float64
+	ts    time.Time
+}
+
+func (c *timestamped) Describe(ch chan<- *prometheus.Desc) { ch <- c.desc }
+
+func (c *timestamped) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.NewMetricWithTimestamp(c.ts, prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, c.value, "primary", ""))
+}
+
+func TestRemoteWriteExport(t *testing.T) {
+	ts := time.UnixMilli(1700000000123)
+	tests := []struct {
+		name         string
+		codes        []int
+		maxRetries   int
+		wantErr      bool
+		wantRequests int
+		wantSeries   []prompb.TimeSeries
+	}{
+		{
+			name:         "labels and timestamps",
+			codes:        []int{http.StatusNoContent},
+			wantRequests: 1,
+			wantSeries: []prompb.TimeSeries{{
+				Labels:  []prompb.Label{{Name: "__name__", Value: "test_mysql_orders"}, {Name: "name", Value: "primary"}},
+				Samples: []prompb.Sample{{Value: 3, Timestamp: ts.UnixMilli()}},
+			}},
+		},
+		{
+			name:         "retries on 5xx and 429",
+			codes:        []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK},
+			maxRetries:   3,
+			wantRequests: 3,
+			wantSeries: []prompb.TimeSeries{{
+				Labels:  []prompb.Label{{Name: "__name__", Value: "test_mysql_orders"}, {Name: "name", Value: "primary"}},
+				Samples: []prompb.Sample{{Value: 3, Timestamp: ts.UnixMilli()}},
+			}},
+		},
+		{
+			name:         "gives up after max retries",
+			codes:        []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError},
+			maxRetries:   1,
+			wantErr:      true,
+			wantRequests: 2,
+		},
+		{
+			name:         "drops samples rejected by receiver",
+			codes:        []int{http.StatusBadRequest},
+			maxRetries:   3,
+			wantRequests: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu       sync.Mutex
+				requests int
+				received []prompb.TimeSeries
+			)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				code := tt.codes[min(requests, len(tt.codes)-1)]
+				requests++
+				if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+					t.Errorf("unexpected headers %v", r.Header)
+				}
+				compressed, _ := io.ReadAll(r.Body)
+				data, err := snappy.Decode(nil, compressed)
+				if err != nil {
+					t.Errorf("failed to decode snappy, err: %v", err)
+				}
+				var req prompb.WriteRequest
+				if err = req.Unmarshal(data); err != nil {
+					t.Errorf("failed to unmarshal write request, err: %v", err)
+				}
+				if code/100 == 2 {
+					received = append(received, req.Timeseries...)
+				}
+				w.WriteHeader(code)
+			}))
+			defer srv.Close()
+
+			reg := prometheus.NewRegistry()
+			reg.MustRegister(&timestamped{
+				desc:  prometheus.NewDesc("test_mysql_orders", "Orders.", []string{"name", "table"}, nil),
+				value: 3,
+				ts:    ts,
+			})
+			rw := NewRemoteWrite(discardLogger, srv.URL, RemoteWriteOptions{MaxRetries: tt.maxRetries, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			err := Run(ctx, discardLogger, reg, rw, 0)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if requests != tt.wantRequests {
+				t.Fatalf("got %d requests, want %d", requests, tt.wantRequests)
+			}
+			if !reflect.DeepEqual(received, tt.wantSeries) {
+				t.Fatalf("got series %v, want %v", received, tt.wantSeries)
+			}
+		})
+	}
+}
+
+func TestRemoteWriteExportDoesNotWaitOnReceiver(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_gauge", Help: "Test."}))
+	rw := NewRemoteWrite(discardLogger, srv.URL, RemoteWriteOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- rw.Export(ctx, reg) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("export waits on the receiver")
+	}
+}
+
+func TestRemoteWriteFlushesOnTermination(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+		series   int
+		received = make(chan struct{})
+	)
+	// the first request hangs until the sender gives up on termination
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		first := requests == 1
+		mu.Unlock()
+		// the context of a request is only cancelled on disconnect once its body is read
+		compressed, _ := io.ReadAll(r.Body)
+		if first {
+			close(received)
+			<-r.Context().Done()
+			return
+		}
+		data, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Errorf("failed to decode snappy, err: %v", err)
+		}
+		var req prompb.WriteRequest
+		if err = req.Unmarshal(data); err != nil {
+			t.Errorf("failed to unmarshal write request, err: %v", err)
+		}
+		mu.Lock()
+		series += len(req.Timeseries)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_gauge", Help: "Test."}))
+	rw := NewRemoteWrite(discardLogger, srv.URL, RemoteWriteOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- Run(ctx, discardLogger, reg, rw, time.Hour) }()
+	<-received
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run does not return on termination")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if series != 1 {
+		t.Fatalf("got %d series sent after termination, want 1", series)
+	}
+}
@@ -0,0 +1,23 @@
+package output
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Textfile writes metrics into a file for the textfile collector of node_exporter
+type Textfile struct {
+	path string
+}
+
+func NewTextfile(dir, filename string) *Textfile {
+	return &Textfile{path: filepath.Join(dir, filename)}
+}
+
+// Export writes into a temporary file in the same directory and renames it afterwards,
+// so that node_exporter never reads a partially written file.
+func (t *Textfile) Export(_ context.Context, g prometheus.Gatherer) error {
+	return prometheus.WriteToTextfile(t.path, g)
+}
@@ -0,0 +1,45 @@
+package output
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestTextfileExport(t *testing.T) {
+	tests := []struct {
+		name  string
+		value float64
+		want  string
+	}{
+		{name: "first export", value: 1, want: "# HELP orders Orders.\n# TYPE orders gauge\norders 1\n"},
+		{name: "overwrites previous file", value: 2, want: "# HELP orders Orders.\n# TYPE orders gauge\norders 2\n"},
+	}
+	dir := t.TempDir()
+	e := NewTextfile(dir, "queryexporter.prom")
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "orders", Help: "Orders."})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(gauge)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gauge.Set(tt.value)
+			if err := e.Export(context.Background(), reg); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(filepath.Join(dir, "queryexporter.prom"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Fatalf("got %q, want %q", data, tt.want)
+			}
+			entries, _ := os.ReadDir(dir)
+			if len(entries) != 1 {
+				t.Fatalf("temporary files are left in %s: %v", dir, entries)
+			}
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package conn
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/multierr"
+
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+// DefaultIdleTimeout is the time after which a client that hasn't been used is closed
+const DefaultIdleTimeout = 10 * time.Minute
+
+// Options of Manager, Open and Close are required
+type Options[C any] struct {
+	// Open creates a client for the datasource
+	Open func(ctx context.Context, ds *types.DataSource) (C, error)
+	// Close releases resources held by the client
+	Close func(c C) error
+	// IsAuthError reports whether err is caused by rejected credentials,
+	// clients are reopened on such errors
+	IsAuthError func(err error) bool
+	IdleTimeout time.Duration
+}
+
+type entry[C any] struct {
+	server string
+	client C
+	// ready is closed once the client is opened, err is set if it failed
+	ready chan struct{}
+	err   error
+
+	// fields below are guarded by mu of the manager
+	lastUsed time.Time
+	// refs counts callers using the client
+	refs int
+	// stale is set once the entry is removed from the manager, the client is
+	// closed when its last user releases it
+	stale bool
+}
+
+type key struct {
+	server string
+	uri    string
+}
+
+// Manager caches clients of a driver per server and uri. A changed uri, e.g. after
+// credentials rotated, gets a new client while the stale one is evicted once idle.
+// Clients are opened and closed without holding the lock, so a slow server never
+// blocks queries against other servers.
+type Manager[C any] struct {
+	opts Options[C]
+
+	mu        sync.Mutex
+	clients   map[key]*entry[C]
+	lastSweep time.Time
+}
+
+func New[C any](opts Options[C]) *Manager[C] {
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = DefaultIdleTimeout
+	}
+	return &Manager[C]{
+		opts:      opts,
+		clients:   make(map[key]*entry[C]),
+		lastSweep: time.Now(),
+	}
+}
+
+// acquire returns the entry of the datasource with a reference held, the client is
+// opened if there is none. Concurrent callers wait for the same open. If touch is
+// false the client isn't marked used, so that it's still evicted once idle.
+func (m *Manager[C]) acquire(ctx context.Context, ds *types.DataSource, touch bool) (*entry[C], error) {
+	k := key{server: ds.Name, uri: ds.URI}
+	m.mu.Lock()
+	idle := m.sweepLocked()
+	e, ok := m.clients[k]
+	if !ok {
+		e = &entry[C]{server: ds.Name, ready: make(chan struct{}), lastUsed: time.Now()}
+		m.clients[k] = e
+	}
+	e.refs++
+	if touch {
+		e.lastUsed = time.Now()
+	}
+	m.mu.Unlock()
+	m.closeAll(idle)
+
+	if !ok {
+		e.client, e.err = m.opts.Open(ctx, ds)
+		if e.err != nil {
+			m.mu.Lock()
+			if m.clients[k] == e {
+				delete(m.clients, k)
+			}
+			m.mu.Unlock()
+		}
+		close(e.ready)
+	} else {
+		select {
+		case <-e.ready:
+		case <-ctx.Done():
+			m.release(e)
+			return nil, ctx.Err()
+		}
+	}
+	if e.err != nil {
+		// failed entries are never closed
+		m.mu.Lock()
+		e.refs--
+		m.mu.Unlock()
+		return nil, e.err
+	}
+	return e, nil
+}
+
+// release drops a reference of e, and closes its client if it's stale and unused.
+// The opener holds a reference until the open is done, so err is settled once unused.
+func (m *Manager[C]) release(e *entry[C]) {
+	m.mu.Lock()
+	e.refs--
+	closing := e.stale && e.refs == 0 && e.err == nil
+	m.mu.Unlock()
+	if closing {
+		m.opts.Close(e.client)
+	}
+}
+
+// evict removes e from the manager if it's still cached, its client is closed
+// once unused.
+func (m *Manager[C]) evict(k key, e *entry[C]) error {
+	m.mu.Lock()
+	if m.clients[k] != e {
+		m.mu.Unlock()
+		return nil
+	}
+	delete(m.clients, k)
+	e.stale = true
+	closing := e.refs == 0
+	m.mu.Unlock()
+	if closing {
+		return m.opts.Close(e.client)
+	}
+	return nil
+}
+
+// Open opens the client of the datasource if there is none, and marks it used
+func (m *Manager[C]) Open(ctx context.Context, ds *types.DataSource) error {
+	e, err := m.acquire(ctx, ds, true)
+	if err != nil {
+		return err
+	}
+	m.release(e)
+	return nil
+}
+
+// Do runs fn with the client of the datasource. If fn fails because of rejected
+// credentials, the client is reopened and fn is retried once.
+func (m *Manager[C]) Do(ctx context.Context, ds *types.DataSource, fn func(c C) error) error {
+	release, err := m.Borrow(ctx, ds, fn)
+	if err != nil {
+		return err
+	}
+	release()
+	return nil
+}
+
+// Borrow is like Do, but the client stays in use until release is called, e.g. while
+// rows of a query are read. release is nil if err is not nil.
+func (m *Manager[C]) Borrow(ctx context.Context, ds *types.DataSource, fn func(c C) error) (release func(), err error) {
+	return m.borrow(ctx, ds, true, fn)
+}
+
+// Peek is like Do, but the client isn't marked used, so that health checks don't
+// keep idle clients from being evicted.
+func (m *Manager[C]) Peek(ctx context.Context, ds *types.DataSource, fn func(c C) error) error {
+	release, err := m.borrow(ctx, ds, false, fn)
+	if err != nil {
+		return err
+	}
+	release()
+	return nil
+}
+
+func (m *Manager[C]) borrow(ctx context.Context, ds *types.DataSource, touch bool, fn func(c C) error) (func(), error) {
+	e, err := m.acquire(ctx, ds, touch)
+	if err != nil {
+		return nil, err
+	}
+	err = fn(e.client)
+	if err != nil && m.opts.IsAuthError != nil && m.opts.IsAuthError(err) {
+		// callers still using the stale client keep it open until they are done
+		m.evict(key{server: ds.Name, uri: ds.URI}, e)
+		m.release(e)
+		if e, err = m.acquire(ctx, ds, touch); err != nil {
+			return nil, err
+		}
+		err = fn(e.client)
+	}
+	if err != nil {
+		m.release(e)
+		return nil, err
+	}
+	return func() { m.release(e) }, nil
+}
+
+// Evict removes the client of the datasource, it's closed once unused
+func (m *Manager[C]) Evict(ds *types.DataSource) error {
+	k := key{server: ds.Name, uri: ds.URI}
+	m.mu.Lock()
+	e, ok := m.clients[k]
+	m.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return m.evict(k, e)
+}
+
+// sweepLocked removes clients idle longer than IdleTimeout and returns the ones to
+// close, it runs at most once every half of IdleTimeout.
+func (m *Manager[C]) sweepLocked() []*entry[C] {
+	now := time.Now()
+	if now.Sub(m.lastSweep) < m.opts.IdleTimeout/2 {
+		return nil
+	}
+	m.lastSweep = now
+	var idle []*entry[C]
+	for k, e := range m.clients {
+		if e.refs == 0 && now.Sub(e.lastUsed) > m.opts.IdleTimeout {
+			delete(m.clients, k)
+			e.stale = true
+			idle = append(idle, e)
+		}
+	}
+	return idle
+}
+
+func (m *Manager[C]) closeAll(entries []*entry[C]) error {
+	var errs []error
+	for _, e := range entries {
+		if err := m.opts.Close(e.client); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return multierr.Combine(errs...)
+}
+
+// Range calls fn for the opened clients in order of server names. If a server has
+// several clients, e.g. a stale one not yet evicted, only the last used one is visited.
+func (m *Manager[C]) Range(fn func(server string, c C)) {
+	m.mu.Lock()
+	latest := make(map[string]*entry[C], len(m.clients))
+	for _, e := range m.clients {
+		select {
+		case <-e.ready:
+			if e.err != nil {
+				continue
+			}
+		default:
+			continue
+		}
+		if prev, ok := latest[e.server]; !ok || e.lastUsed.After(prev.lastUsed) {
+			latest[e.server] = e
+		}
+	}
+	entries := make([]*entry[C], 0, len(latest))
+	for _, e := range latest {
+		e.refs++
+		entries = append(entries, e)
+	}
+	m.mu.Unlock()
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].server < entries[j].server })
+	for _, e := range entries {
+		fn(e.server, e.client)
+		m.release(e)
+	}
+}
+
+// Close removes all clients, unused ones are closed at once and others once
+// their users are done.
+func (m *Manager[C]) Close() error {
+	m.mu.Lock()
+	var unused []*entry[C]
+	for k, e := range m.clients {
+		delete(m.clients, k)
+		e.stale = true
+		if e.refs == 0 {
+			unused = append(unused, e)
+		}
+	}
+	m.mu.Unlock()
+	return m.closeAll(unused)
+}
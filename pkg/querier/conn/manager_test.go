@@ -0,0 +1,303 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+type fakeClient struct {
+	server string
+	pool   *types.PoolConfig
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (c *fakeClient) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *fakeClient) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func newFakeManager(opts Options[*fakeClient]) *Manager[*fakeClient] {
+	if opts.Open == nil {
+		opts.Open = func(_ context.Context, ds *types.DataSource) (*fakeClient, error) {
+			return &fakeClient{server: ds.Name, pool: ds.Pool}, nil
+		}
+	}
+	opts.Close = (*fakeClient).close
+	return New(opts)
+}
+
+func newDataSource(server, uri string, pool *types.PoolConfig) *types.DataSource {
+	return &types.DataSource{Server: types.Server{Name: server, URI: uri}, Pool: pool}
+}
+
+func TestManagerGet(t *testing.T) {
+	small, large := &types.PoolConfig{MaxOpen: 1}, &types.PoolConfig{MaxOpen: 10}
+	tests := []struct {
+		name       string
+		first      *types.DataSource
+		second     *types.DataSource
+		wantShared bool
+	}{
+		{
+			name:       "same server and uri",
+			first:      newDataSource("primary", "mysql://primary", small),
+			second:     newDataSource("primary", "mysql://primary", small),
+			wantShared: true,
+		},
+		{
+			name:   "servers sharing uri",
+			first:  newDataSource("primary", "mysql://db", small),
+			second: newDataSource("reporting", "mysql://db", large),
+		},
+		{
+			name:   "changed uri",
+			first:  newDataSource("primary", "mysql://primary?password=old", small),
+			second: newDataSource("primary", "mysql://primary?password=new", small),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newFakeManager(Options[*fakeClient]{})
+			defer m.Close()
+			first, second := get(t, m, tt.first), get(t, m, tt.second)
+			if (first == second) != tt.wantShared {
+				t.Fatalf("got shared %v, want %v", first == second, tt.wantShared)
+			}
+			// server names and pools come from the datasource of every client
+			if second.server != tt.second.Name || second.pool != tt.second.Pool {
+				t.Fatalf("got client of server %s with pool %v, want %s with %v", second.server, second.pool, tt.second.Name, tt.second.Pool)
+			}
+			var servers []string
+			m.Range(func(server string, _ *fakeClient) { servers = append(servers, server) })
+			if want := 1 + btoi(tt.first.Name != tt.second.Name); len(servers) != want {
+				t.Fatalf("got servers %v, want %d", servers, want)
+			}
+		})
+	}
+}
+
+// get returns the client of ds without holding it
+func get(t *testing.T, m *Manager[*fakeClient], ds *types.DataSource) *fakeClient {
+	t.Helper()
+	var c *fakeClient
+	if err := m.Do(context.Background(), ds, func(client *fakeClient) error {
+		c = client
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func TestManagerOpenOutsideLock(t *testing.T) {
+	var opens atomic.Int32
+	unblock := make(chan struct{})
+	m := newFakeManager(Options[*fakeClient]{
+		Open: func(_ context.Context, ds *types.DataSource) (*fakeClient, error) {
+			opens.Add(1)
+			if ds.Name == "slow" {
+				<-unblock
+			}
+			return &fakeClient{server: ds.Name}, nil
+		},
+	})
+	defer m.Close()
+	slow := newDataSource("slow", "mysql://slow", nil)
+
+	var wg sync.WaitGroup
+	clients := make([]*fakeClient, 3)
+	for i := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			clients[i] = get(t, m, slow)
+		}()
+	}
+	// other servers are not blocked by the slow open
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		get(t, m, newDataSource("fast", "mysql://fast", nil))
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("open of a server is blocked by another one")
+	}
+	close(unblock)
+	wg.Wait()
+	if n := opens.Load(); n != 2 {
+		t.Fatalf("got %d opens, want 2", n)
+	}
+	for _, c := range clients {
+		if c != clients[0] {
+			t.Fatal("concurrent callers got different clients")
+		}
+	}
+}
+
+func TestManagerOpenError(t *testing.T) {
+	var opens atomic.Int32
+	m := newFakeManager(Options[*fakeClient]{
+		Open: func(_ context.Context, ds *types.DataSource) (*fakeClient, error) {
+			if opens.Add(1) == 1 {
+				return nil, errors.New("connection refused")
+			}
+			return &fakeClient{server: ds.Name}, nil
+		},
+	})
+	defer m.Close()
+	ds := newDataSource("primary", "mysql://primary", nil)
+	if err := m.Open(context.Background(), ds); err == nil {
+		t.Fatal("expected error of the first open")
+	}
+	// failed opens are not cached
+	if err := m.Open(context.Background(), ds); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var errAuth = errors.New("access denied")
+
+func TestManagerAuthError(t *testing.T) {
+	tests := []struct {
+		name string
+		// holding keeps the first client in use while credentials are rejected
+		holding bool
+	}{
+		{name: "unused client is closed at once"},
+		{name: "client in use is closed once released", holding: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newFakeManager(Options[*fakeClient]{IsAuthError: func(err error) bool { return errors.Is(err, errAuth) }})
+			defer m.Close()
+			ds := newDataSource("primary", "mysql://primary", nil)
+			var first *fakeClient
+			release, err := m.Borrow(context.Background(), ds, func(c *fakeClient) error {
+				first = c
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.holding {
+				release()
+			}
+
+			var used []*fakeClient
+			err = m.Do(context.Background(), ds, func(c *fakeClient) error {
+				used = append(used, c)
+				if c == first {
+					return errAuth
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(used) != 2 || used[1] == first {
+				t.Fatalf("query is not retried with a new client: %v", used)
+			}
+			if first.isClosed() == tt.holding {
+				t.Fatalf("got stale client closed %v, want %v", first.isClosed(), !tt.holding)
+			}
+			if tt.holding {
+				release()
+				if !first.isClosed() {
+					t.Fatal("stale client is not closed once released")
+				}
+			}
+			if used[1].isClosed() {
+				t.Fatal("new client is closed")
+			}
+		})
+	}
+}
+
+func TestManagerIdleEviction(t *testing.T) {
+	tests := []struct {
+		name string
+		use  func(m *Manager[*fakeClient], ds *types.DataSource) error
+		want bool
+	}{
+		{
+			name: "queries keep clients open",
+			use: func(m *Manager[*fakeClient], ds *types.DataSource) error {
+				return m.Do(context.Background(), ds, func(*fakeClient) error { return nil })
+			},
+			want: false,
+		},
+		{
+			name: "pings don't keep clients open",
+			use: func(m *Manager[*fakeClient], ds *types.DataSource) error {
+				return m.Peek(context.Background(), ds, func(*fakeClient) error { return nil })
+			},
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newFakeManager(Options[*fakeClient]{IdleTimeout: 100 * time.Millisecond})
+			defer m.Close()
+			ds := newDataSource("primary", "mysql://primary", nil)
+			c := get(t, m, ds)
+			for range 10 {
+				time.Sleep(30 * time.Millisecond)
+				if err := tt.use(m, ds); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if c.isClosed() != tt.want {
+				t.Fatalf("got client closed %v, want %v", c.isClosed(), tt.want)
+			}
+		})
+	}
+}
+
+func TestManagerClose(t *testing.T) {
+	m := newFakeManager(Options[*fakeClient]{})
+	idle, busy := newDataSource("idle", "mysql://idle", nil), newDataSource("busy", "mysql://busy", nil)
+	idleClient := get(t, m, idle)
+	var busyClient *fakeClient
+	release, err := m.Borrow(context.Background(), busy, func(c *fakeClient) error {
+		busyClient = c
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !idleClient.isClosed() || busyClient.isClosed() {
+		t.Fatalf("got idle closed %v and busy closed %v, want true and false", idleClient.isClosed(), busyClient.isClosed())
+	}
+	release()
+	if !busyClient.isClosed() {
+		t.Fatal("client in use is not closed once released")
+	}
+}
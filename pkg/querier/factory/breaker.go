@@ -0,0 +1,168 @@
+package factory
+
+import (
+	"errors"
+	"iter"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+// ErrCircuitOpen is returned for queries against a server whose circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// states of circuit breakers, they are the values of the state gauge
+const (
+	stateClosed = iota
+	stateOpen
+	stateHalfOpen
+)
+
+type breaker struct {
+	threshold   int
+	openTimeout time.Duration
+	gauge       prometheus.Gauge
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	// probing is set while the single query allowed in half-open state runs
+	probing bool
+}
+
+func (b *breaker) setState(state int) {
+	b.state = state
+	b.gauge.Set(float64(state))
+}
+
+// allow reports whether a query may run, every allowed query must be followed by a
+// call of done or release.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case stateOpen:
+		if time.Since(b.openedAt) < b.openTimeout {
+			return false
+		}
+		b.setState(stateHalfOpen)
+		b.probing = true
+		return true
+	case stateHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// release gives up the probe of an allowed query which never reached the server,
+// e.g. cancelled while waiting for limits.
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// done records the result of an allowed query, class is the class of its error or
+// empty if it succeeded. Only transient errors count as failures of the server,
+// permanent ones, e.g. a syntax error or a cancelled query, neither count nor reset
+// failures.
+func (b *breaker) done(class string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	switch class {
+	case types.ErrorClassPermanent:
+		return
+	case "":
+		b.failures = 0
+		if b.state != stateClosed {
+			b.setState(stateClosed)
+		}
+		return
+	}
+	b.failures++
+	if b.state == stateHalfOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		b.setState(stateOpen)
+	}
+}
+
+// observe returns seq which records results of the driver by done, and guard which
+// wraps seq, e.g. together with waits for limits, so that an open circuit fails fast
+// before waiting. guard asks the breaker only once it's iterated, so that queries
+// shared with other metrics ask once, and releases queries which never reached seq.
+func (b *breaker) observe(iface Interface, seq iter.Seq2[types.Result, error]) (observed iter.Seq2[types.Result, error], guard func(iter.Seq2[types.Result, error]) iter.Seq2[types.Result, error]) {
+	executed := false
+	observed = func(yield func(types.Result, error) bool) {
+		executed = true
+		for ret, err := range seq {
+			if err != nil {
+				b.done(classify(iface, err))
+				yield(nil, err)
+				return
+			}
+			if !yield(ret, nil) {
+				b.done("")
+				return
+			}
+		}
+		b.done("")
+	}
+	guard = func(seq iter.Seq2[types.Result, error]) iter.Seq2[types.Result, error] {
+		return func(yield func(types.Result, error) bool) {
+			if !b.allow() {
+				yield(nil, ErrCircuitOpen)
+				return
+			}
+			executed = false
+			defer func() {
+				if !executed {
+					b.release()
+				}
+			}()
+			for ret, err := range seq {
+				if !yield(ret, err) {
+					return
+				}
+			}
+		}
+	}
+	return observed, guard
+}
+
+type breakers struct {
+	mu      sync.RWMutex
+	servers map[string]*breaker
+}
+
+func (b *breakers) get(server string) *breaker {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.servers[server]
+}
+
+// SetCircuitBreakers sets circuit breakers of servers by name, servers absent have none.
+// It should be called before scraping.
+func (f *Factory) SetCircuitBreakers(servers map[string]*types.CircuitBreaker) {
+	f.breakers.mu.Lock()
+	defer f.breakers.mu.Unlock()
+	f.metrics.breakerState.Reset()
+	f.breakers.servers = make(map[string]*breaker, len(servers))
+	for server, cb := range servers {
+		b := &breaker{
+			threshold:   cb.FailureThreshold,
+			openTimeout: time.Duration(cb.OpenTimeout),
+			gauge:       f.metrics.breakerState.WithLabelValues(server),
+		}
+		b.setState(stateClosed)
+		f.breakers.servers[server] = b
+	}
+}
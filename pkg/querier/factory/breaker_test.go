@@ -0,0 +1,178 @@
+package factory
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	const openTimeout = 50 * time.Millisecond
+	transient := syscall.ECONNREFUSED
+	permanent := errors.New("syntax error")
+	// step is a query of a scrape, wait passes before it
+	type step struct {
+		err       error
+		wait      time.Duration
+		wantQuery bool
+		wantState int
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "closed to open to half-open to closed",
+			steps: []step{
+				{err: transient, wantQuery: true, wantState: stateClosed},
+				{err: transient, wantQuery: true, wantState: stateOpen},
+				{wantState: stateOpen},
+				{wait: openTimeout, wantQuery: true, wantState: stateClosed},
+				{wantQuery: true, wantState: stateClosed},
+			},
+		},
+		{
+			name: "failed probe opens again",
+			steps: []step{
+				{err: transient, wantQuery: true, wantState: stateClosed},
+				{err: transient, wantQuery: true, wantState: stateOpen},
+				{wait: openTimeout, err: transient, wantQuery: true, wantState: stateOpen},
+				{wantState: stateOpen},
+			},
+		},
+		{
+			name: "permanent errors count nothing",
+			steps: []step{
+				{err: permanent, wantQuery: true, wantState: stateClosed},
+				{err: permanent, wantQuery: true, wantState: stateClosed},
+				{err: permanent, wantQuery: true, wantState: stateClosed},
+			},
+		},
+		{
+			name: "permanent errors reset nothing",
+			steps: []step{
+				{err: transient, wantQuery: true, wantState: stateClosed},
+				{err: permanent, wantQuery: true, wantState: stateClosed},
+				{err: transient, wantQuery: true, wantState: stateOpen},
+			},
+		},
+		{
+			name: "permanent error of probe keeps half-open",
+			steps: []step{
+				{err: transient, wantQuery: true, wantState: stateClosed},
+				{err: transient, wantQuery: true, wantState: stateOpen},
+				{wait: openTimeout, err: permanent, wantQuery: true, wantState: stateHalfOpen},
+				{wantQuery: true, wantState: stateClosed},
+			},
+		},
+		{
+			name: "success resets failures",
+			steps: []step{
+				{err: transient, wantQuery: true, wantState: stateClosed},
+				{wantQuery: true, wantState: stateClosed},
+				{err: transient, wantQuery: true, wantState: stateClosed},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			d := &fakeDriver{query: func(context.Context, *types.DataSource, string) ([]types.Result, error) {
+				return []types.Result{{"value": 1}}, err
+			}}
+			f := newTestFactory(d)
+			f.SetCircuitBreakers(map[string]*types.CircuitBreaker{"primary": {FailureThreshold: 2, OpenTimeout: model.Duration(openTimeout)}})
+			ds := newDataSource("primary")
+			metric := &types.MetricDesc{Name: "orders", VariableValue: "value", Query: "orders"}
+			for i, s := range tt.steps {
+				time.Sleep(s.wait)
+				err = s.err
+				before := d.callsOf(ds, metric.Query)
+				_, perr := process(context.Background(), f, []*types.DataSource{ds}, metric)
+				if queried := d.callsOf(ds, metric.Query) > before; queried != s.wantQuery {
+					t.Fatalf("step %d: got queried %v, want %v", i, queried, s.wantQuery)
+				}
+				if !s.wantQuery && (perr == nil || !strings.Contains(perr.Error(), ErrCircuitOpen.Error())) {
+					t.Fatalf("step %d: got error %v, want %v", i, perr, ErrCircuitOpen)
+				}
+				if got := testutil.ToFloat64(f.metrics.breakerState.WithLabelValues("primary")); got != float64(s.wantState) {
+					t.Fatalf("step %d: got state %v, want %v", i, got, s.wantState)
+				}
+			}
+		})
+	}
+}
+
+// TestCircuitBreakerSharedProbe runs a query shared by two metrics concurrently in
+// half-open state, only the metric running it takes the probe and both receive its results.
+func TestCircuitBreakerSharedProbe(t *testing.T) {
+	var (
+		fail    = true
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+	d := &fakeDriver{query: func(context.Context, *types.DataSource, string) ([]types.Result, error) {
+		if fail {
+			return nil, io.ErrUnexpectedEOF
+		}
+		close(started)
+		<-release
+		return []types.Result{{"value": 1, "other": 2}}, nil
+	}}
+	f := newTestFactory(d)
+	f.SetCircuitBreakers(map[string]*types.CircuitBreaker{"primary": {FailureThreshold: 1, OpenTimeout: model.Duration(time.Millisecond)}})
+	ds := newDataSource("primary")
+	first := &types.MetricDesc{Name: "orders", VariableValue: "value", Query: "orders"}
+	second := &types.MetricDesc{Name: "other_orders", VariableValue: "other", Query: "orders"}
+	if _, err := process(context.Background(), f, []*types.DataSource{ds}, first); err == nil {
+		t.Fatal("expected error opening the circuit")
+	}
+	fail = false
+	time.Sleep(10 * time.Millisecond)
+
+	scrape := NewScrape()
+	scrape.Expect(fakeDriverName, ds, first.Query)
+	scrape.Expect(fakeDriverName, ds, second.Query)
+	ctx := WithScrape(context.Background(), scrape)
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, metric := range []*types.MetricDesc{first, second} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			metrics, err := process(ctx, f, []*types.DataSource{ds}, metric)
+			if err == nil && len(metrics) != 1 {
+				err = errors.New("no series")
+			}
+			errs[i] = err
+		}()
+		if i == 0 {
+			<-started
+		}
+	}
+	// the second metric waits for the probe run by the first one
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error of metric %d: %v", i, err)
+		}
+	}
+	if got := d.callsOf(ds, first.Query); got != 2 {
+		t.Fatalf("got %d queries, want 2", got)
+	}
+	if got := testutil.ToFloat64(f.metrics.breakerState.WithLabelValues("primary")); got != stateClosed {
+		t.Fatalf("got state %v, want %v", got, stateClosed)
+	}
+}
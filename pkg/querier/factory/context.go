@@ -0,0 +1,50 @@
+package factory
+
+import (
+	"context"
+
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+// Tracer receives the rendered query and raw results of every datasource processed,
+// it is useful for debugging metric definitions.
+type Tracer func(ds *types.DataSource, query string, rets []types.Result, err error)
+
+type tracerKey struct{}
+
+func getTracer(ctx context.Context) Tracer {
+	if tracer, ok := ctx.Value(tracerKey{}).(Tracer); ok {
+		return tracer
+	}
+	return nil
+}
+
+// WithTracer returns a copy of ctx in which tracer will be called by Process
+func WithTracer(ctx context.Context, tracer Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, tracer)
+}
+
+type timestampsKey struct{}
+
+func withTimestamps(ctx context.Context) bool {
+	v, _ := ctx.Value(timestampsKey{}).(bool)
+	return v
+}
+
+// WithTimestamps returns a copy of ctx in which metrics created by Process carry
+// the time their result was read as timestamp.
+func WithTimestamps(ctx context.Context) context.Context {
+	return context.WithValue(ctx, timestampsKey{}, true)
+}
+
+type varsKey struct{}
+
+func getVars(ctx context.Context) map[string]any {
+	vars, _ := ctx.Value(varsKey{}).(map[string]any)
+	return vars
+}
+
+// WithVars returns a copy of ctx in which vars are available to query templates as .Vars
+func WithVars(ctx context.Context, vars map[string]any) context.Context {
+	return context.WithValue(ctx, varsKey{}, vars)
+}
@@ -0,0 +1,130 @@
+package factory
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"sync"
+
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+type queryKey struct {
+	driver, server, database, table, query string
+}
+
+func newQueryKey(driver string, ds *types.DataSource, query string) queryKey {
+	return queryKey{driver: driver, server: ds.Name, database: ds.Database, table: ds.Table, query: query}
+}
+
+type flight struct {
+	done chan struct{}
+	rets []types.Result
+	err  error
+}
+
+// Scrape deduplicates identical queries of different metrics within a scrape, a query
+// run by several metrics against the same datasource is executed once and its results
+// are shared. Results of shared queries are buffered, other queries are streamed.
+type Scrape struct {
+	// ctx bounds shared queries, so that they aren't cancelled together with the
+	// metric that happens to run them
+	ctx context.Context
+	// expected counts metrics by query template, only templates expected more than
+	// once are deduplicated
+	expected map[queryKey]int
+
+	mu sync.Mutex
+	// flights are keyed by rendered queries
+	flights map[queryKey]*flight
+}
+
+func NewScrape() *Scrape {
+	return &Scrape{
+		ctx:      context.Background(),
+		expected: make(map[queryKey]int),
+		flights:  make(map[queryKey]*flight),
+	}
+}
+
+// Expect announces that query of a metric will be run against ds within the scrape,
+// it must be called before the scrape starts.
+func (s *Scrape) Expect(driver string, ds *types.DataSource, query string) {
+	s.expected[newQueryKey(driver, ds, query)]++
+}
+
+func (s *Scrape) shared(driver string, ds *types.DataSource, query string) bool {
+	return s.expected[newQueryKey(driver, ds, query)] > 1
+}
+
+// do runs fn once for every key, later callers wait for and share results of the first one.
+// shared reports whether results come from another caller. A run cancelled before it's
+// done isn't shared, the next caller runs fn again instead.
+func (s *Scrape) do(ctx context.Context, key queryKey, fn func() ([]types.Result, error)) (rets []types.Result, err error, shared bool) {
+	for {
+		s.mu.Lock()
+		f, ok := s.flights[key]
+		if !ok {
+			f = &flight{done: make(chan struct{})}
+			s.flights[key] = f
+			s.mu.Unlock()
+			rets, err = s.run(key, f, fn)
+			return rets, err, false
+		}
+		s.mu.Unlock()
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, ctx.Err(), true
+		}
+		if !isCanceled(f.err) {
+			return f.rets, f.err, true
+		}
+	}
+}
+
+// run runs fn for the flight f, a cancelled run is removed so that it isn't shared
+func (s *Scrape) run(key queryKey, f *flight, fn func() ([]types.Result, error)) ([]types.Result, error) {
+	defer close(f.done)
+	f.rets, f.err = fn()
+	if isCanceled(f.err) {
+		s.mu.Lock()
+		delete(s.flights, key)
+		s.mu.Unlock()
+	}
+	return f.rets, f.err
+}
+
+func isCanceled(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+type scrapeCtxKey struct{}
+
+func getScrape(ctx context.Context) *Scrape {
+	s, _ := ctx.Value(scrapeCtxKey{}).(*Scrape)
+	return s
+}
+
+// WithScrape returns a copy of ctx in which identical queries run by Process are
+// deduplicated by s, shared queries are run under the returned ctx.
+func WithScrape(ctx context.Context, s *Scrape) context.Context {
+	ctx = context.WithValue(ctx, scrapeCtxKey{}, s)
+	s.ctx = ctx
+	return ctx
+}
+
+// results yields buffered results as a sequence
+func results(rets []types.Result, err error) iter.Seq2[types.Result, error] {
+	return func(yield func(types.Result, error) bool) {
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		for _, ret := range rets {
+			if !yield(ret, nil) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package factory
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+func TestScrapeDo(t *testing.T) {
+	rets := []types.Result{{"value": 1}}
+	tests := []struct {
+		name       string
+		leaderErr  error
+		wantRuns   int
+		wantErr    bool
+		wantShared bool
+	}{
+		{name: "results shared", wantRuns: 1, wantShared: true},
+		{name: "error shared", leaderErr: errors.New("syntax error"), wantRuns: 1, wantErr: true, wantShared: true},
+		{name: "cancelled run not shared", leaderErr: context.Canceled, wantRuns: 2},
+		{name: "timed out run not shared", leaderErr: context.DeadlineExceeded, wantRuns: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewScrape()
+			key := newQueryKey(fakeDriverName, newDataSource("primary"), "orders")
+			runs := 0
+			started, finish := make(chan struct{}), make(chan struct{})
+			go s.do(context.Background(), key, func() ([]types.Result, error) {
+				runs++
+				close(started)
+				<-finish
+				return rets, tt.leaderErr
+			})
+			<-started
+			done := make(chan struct{})
+			var (
+				got    []types.Result
+				err    error
+				shared bool
+			)
+			go func() {
+				defer close(done)
+				got, err, shared = s.do(context.Background(), key, func() ([]types.Result, error) {
+					runs++
+					return rets, nil
+				})
+			}()
+			close(finish)
+			<-done
+			if runs != tt.wantRuns {
+				t.Fatalf("got %d runs, want %d", runs, tt.wantRuns)
+			}
+			if (err != nil) != tt.wantErr || shared != tt.wantShared {
+				t.Fatalf("got error %v and shared %v, want error %v and shared %v", err, shared, tt.wantErr, tt.wantShared)
+			}
+			if !tt.wantErr && len(got) != len(rets) {
+				t.Fatalf("got %d results, want %d", len(got), len(rets))
+			}
+		})
+	}
+}
+
+func TestProcessDeduplicated(t *testing.T) {
+	tests := []struct {
+		name      string
+		queries   [2]string
+		wantCalls int
+	}{
+		{name: "identical queries", queries: [2]string{"orders", "orders"}, wantCalls: 1},
+		{name: "different queries", queries: [2]string{"orders", "paid orders"}, wantCalls: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &fakeDriver{query: func(context.Context, *types.DataSource, string) ([]types.Result, error) {
+				return []types.Result{{"value": 1, "other": 2}}, nil
+			}}
+			f := newTestFactory(d)
+			ds := newDataSource("primary")
+			first := &types.MetricDesc{Name: "orders", VariableValue: "value", Query: tt.queries[0]}
+			second := &types.MetricDesc{Name: "other_orders", VariableValue: "other", Query: tt.queries[1]}
+			scrape := NewScrape()
+			scrape.Expect(fakeDriverName, ds, first.Query)
+			scrape.Expect(fakeDriverName, ds, second.Query)
+			ctx := WithScrape(context.Background(), scrape)
+			for _, metric := range []*types.MetricDesc{first, second} {
+				metrics, err := process(ctx, f, []*types.DataSource{ds}, metric)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(metrics) != 1 {
+					t.Fatalf("got %d series of %s, want 1", len(metrics), metric.Name)
+				}
+			}
+			calls := d.callsOf(ds, tt.queries[0])
+			if tt.queries[1] != tt.queries[0] {
+				calls += d.callsOf(ds, tt.queries[1])
+			}
+			if calls != tt.wantCalls {
+				t.Fatalf("got %d queries, want %d", calls, tt.wantCalls)
+			}
+			if got := testutil.ToFloat64(f.metrics.deduplicated.WithLabelValues(fakeDriverName, "primary", "other_orders")); got != float64(2-tt.wantCalls) {
+				t.Fatalf("got %v deduplicated queries, want %d", got, 2-tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestScrapeDoWaitCancelled(t *testing.T) {
+	s := NewScrape()
+	key := newQueryKey(fakeDriverName, newDataSource("primary"), "orders")
+	started, finish := make(chan struct{}), make(chan struct{})
+	defer close(finish)
+	go s.do(context.Background(), key, func() ([]types.Result, error) {
+		close(started)
+		<-finish
+		return nil, nil
+	})
+	<-started
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err, _ := s.do(ctx, key, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+// TestProcessSharedQueryOutlivesMetric runs a query shared by two metrics, where the
+// metric running it first fails on another datasource while the query is in flight.
+func TestProcessSharedQueryOutlivesMetric(t *testing.T) {
+	started := make(chan struct{})
+	f := newTestFactory(&fakeDriver{query: func(ctx context.Context, ds *types.DataSource, _ string) ([]types.Result, error) {
+		if ds.Name == "broken" {
+			<-started
+			return nil, errors.New("connection refused")
+		}
+		close(started)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+			return []types.Result{{"value": 1, "other": 2}}, nil
+		}
+	}})
+	primary, broken := newDataSource("primary"), newDataSource("broken")
+	first := &types.MetricDesc{Name: "orders", VariableValue: "value", Query: "orders"}
+	second := &types.MetricDesc{Name: "other_orders", VariableValue: "other", Query: "orders"}
+	scrape := NewScrape()
+	scrape.Expect(fakeDriverName, primary, first.Query)
+	scrape.Expect(fakeDriverName, primary, second.Query)
+	ctx := WithScrape(context.Background(), scrape)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := process(ctx, f, []*types.DataSource{primary, broken}, first)
+		errs <- err
+	}()
+	<-started
+	metrics, err := process(ctx, f, []*types.DataSource{primary}, second)
+	if err != nil {
+		t.Fatalf("unexpected error of second metric: %v", err)
+	}
+	if len(metrics) != 1 {
+		t.Fatalf("got %d series, want 1", len(metrics))
+	}
+	if err = <-errs; err == nil {
+		t.Fatal("expected first metric to fail on broken datasource")
+	}
+	if got := testutil.ToFloat64(f.metrics.deduplicated.WithLabelValues(fakeDriverName, "primary", "other_orders")); got != 1 {
+		t.Fatalf("got %v deduplicated queries, want 1", got)
+	}
+}
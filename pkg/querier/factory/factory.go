@@ -1,15 +1,16 @@
 package factory
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"iter"
 	"log/slog"
-	"sync"
-	"text/template"
+	"sort"
+	"time"
 
-	"github.com/Masterminds/sprig/v3"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/multierr"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/fengxsong/queryexporter/pkg/querier/log"
@@ -18,72 +19,234 @@ import (
 
 type Interface interface {
 	Query(ctx context.Context, ds *types.DataSource, query string) ([]types.Result, error)
+	// Validate checks the rendered query against the datasource without executing it,
+	// so that malformed queries are rejected at config load instead of scrape time.
+	Validate(ds *types.DataSource, query string) error
 }
 
+// Pinger is implemented by queriers that can check connectivity of a datasource
+// without running a query.
+type Pinger interface {
+	Ping(ctx context.Context, ds *types.DataSource) error
+}
+
+// Closer is implemented by queriers holding clients that should be closed on shutdown
+type Closer interface {
+	Close() error
+}
+
+// Driver is the extended interface of queriers managing connections of datasources,
+// all built-in drivers implement it.
+type Driver interface {
+	Interface
+	Pinger
+	Closer
+	// Open establishes the client of the datasource ahead of the first query
+	Open(ctx context.Context, ds *types.DataSource) error
+}
+
+// ErrNotSupported is returned when the driver does not implement an optional interface
+var ErrNotSupported = errors.New("not supported by driver")
+
 type Factory struct {
-	queriers map[string]Interface
+	queriers    map[string]Interface
+	metrics     *metrics
+	lastScrapes lastScrapes
+	queries     queryCache
+	limits      limits
+	rateLimits  rateLimits
+	breakers    breakers
+}
+
+func (f *Factory) get(driver string) (Interface, error) {
+	iface, ok := f.queriers[driver]
+	if !ok {
+		return nil, fmt.Errorf("querier %s not implemented yet", driver)
+	}
+	return iface, nil
+}
+
+// Validate checks that the driver is registered, the query template of metric
+// can be parsed and rendered with vars, and the rendered query is accepted by
+// the driver for every datasource. The parsed template is cached for Process.
+func (f *Factory) Validate(driver string, dss []*types.DataSource, metric *types.MetricDesc, vars map[string]any) error {
+	iface, err := f.get(driver)
+	if err != nil {
+		return err
+	}
+	q, err := f.queries.compile(metric.Query)
+	if err != nil {
+		return fmt.Errorf("failed to parse query of metric %s, err: %v", metric.String(), err)
+	}
+	now := time.Now()
+	for _, ds := range dss {
+		query := metric.Query
+		if !q.static {
+			if query, err = render(q.tpl, newTemplateData(ds, now, time.Time{}, vars)); err != nil {
+				return fmt.Errorf("failed to render query of metric %s, err: %v", metric.String(), err)
+			}
+		}
+		if err = iface.Validate(ds, query); err != nil {
+			return fmt.Errorf("invalid query of metric %s for datasource %s, err: %v", metric.String(), ds.String(), err)
+		}
+	}
+	return nil
+}
+
+// Open establishes the client of the datasource, it's a no-op if the driver
+// does not implement Driver.
+func (f *Factory) Open(ctx context.Context, driver string, ds *types.DataSource) error {
+	iface, err := f.get(driver)
+	if err != nil {
+		return err
+	}
+	if d, ok := iface.(Driver); ok {
+		return d.Open(ctx, ds)
+	}
+	return nil
 }
 
-var bufPool = sync.Pool{
-	New: func() any {
-		return &bytes.Buffer{}
-	},
+// Ping checks connectivity of the datasource, ErrNotSupported is returned
+// if the driver does not implement Pinger.
+func (f *Factory) Ping(ctx context.Context, driver string, ds *types.DataSource) error {
+	iface, err := f.get(driver)
+	if err != nil {
+		return err
+	}
+	pinger, ok := iface.(Pinger)
+	if !ok {
+		return ErrNotSupported
+	}
+	return pinger.Ping(ctx, ds)
 }
 
 func (f *Factory) Process(ctx context.Context, logger *slog.Logger, namespace, driver string, dss []*types.DataSource, metric *types.MetricDesc, ch chan<- prometheus.Metric) error {
 	logger = logger.With("driver", driver)
+	now := time.Now()
 	eg, ctx := errgroup.WithContext(ctx)
 	for i := range dss {
 		ds := dss[i]
 		eg.Go(func() error {
-			iface, ok := f.queriers[driver]
-			if !ok {
-				return fmt.Errorf("querier %s not implemented yet", driver)
-			}
-			tp, err := defaultTpl.Clone()
+			iface, err := f.get(driver)
 			if err != nil {
 				return err
 			}
-			tp, err = tp.Parse(metric.Query)
+			q, err := f.queries.compile(metric.Query)
 			if err != nil {
 				return err
 			}
-			buf := bufPool.Get().(*bytes.Buffer)
-			defer func() {
-				buf.Reset()
-				bufPool.Put(buf)
-			}()
-			// currently only support using some template functions
-			if err = tp.Execute(buf, map[string]any{}); err != nil {
-				return err
-			}
-
-			ctx = log.WithLogger(ctx, logger)
-
-			rets, err := iface.Query(ctx, ds, buf.String())
-			if err != nil {
-				if metric.ContinueIfError {
-					logger.Error("failed to query", "datasource", dss, "metric", metric.String(), "err", err)
-					return nil
+			key := scrapeKey{driver: driver, metric: metric.String(), server: ds.Name, database: ds.Database, table: ds.Table}
+			query := metric.Query
+			if !q.static {
+				if query, err = render(q.tpl, newTemplateData(ds, now, f.lastScrapes.get(key), getVars(ctx))); err != nil {
+					return err
 				}
-				return fmt.Errorf("failed to query %s with %s, err: %v", ds.String(), buf.String(), err)
-			}
-			logger.With("driver", driver).Debug("",
-				"datasource", dss, "metric", metric.String(),
-				"results", rets)
-			if len(rets) == 0 && metric.AllowEmptyValue {
-				rets = []types.Result{{}}
 			}
-			for i := range rets {
-				m, err := types.CreateGaugeMetric(namespace, driver, ds, metric, rets[i])
+
+			labels := prometheus.Labels{"driver": driver, "server": ds.Name, "metric": metric.String()}
+			series := f.metrics.series.With(labels)
+			builder := types.NewGaugeBuilder(namespace, driver, ds, metric)
+			send := func(ret types.Result) error {
+				m, err := builder.Build(ret)
 				if err != nil {
 					if metric.ContinueIfError {
 						logger.Error("failed to create metric", "datasource", dss, "metric", metric.String(), "err", err)
-						continue
+						return nil
 					}
 					return err
 				}
+				if withTimestamps(ctx) {
+					m = prometheus.NewMetricWithTimestamp(time.Now(), m)
+				}
 				ch <- m
+				series.Inc()
+				return nil
+			}
+
+			// metrics are sent as results arrive, results are only kept for the tracer
+			tracer := getTracer(ctx)
+			var (
+				traced            []types.Result
+				rows              int
+				queryErr, sendErr error
+			)
+			scrape := getScrape(ctx)
+			shared := scrape != nil && scrape.shared(driver, ds, metric.Query)
+			qctx := ctx
+			if shared {
+				// the query runs on behalf of several metrics, so it's bound by the scrape
+				// instead of the metric running it first
+				qctx = scrape.ctx
+			}
+			qctx = withBytesRead(log.WithLogger(qctx, logger), f.metrics.bytesRead.With(labels))
+			qkey := newQueryKey(driver, ds, query)
+			policy := metric.Retry
+			if policy == nil {
+				policy = ds.Retry
+			}
+			// latency covers the driver only, neither waits for limits nor sending metrics
+			var (
+				elapsed time.Duration
+				queried bool
+			)
+			seq := timed(stream(qctx, iface, ds, query), &elapsed, &queried)
+			var guard func(iter.Seq2[types.Result, error]) iter.Seq2[types.Result, error]
+			if br := f.breakers.get(ds.Name); br != nil {
+				seq, guard = br.observe(iface, seq)
+			}
+			seq = f.limited(qctx, ds, f.metrics.queueWait.With(labels), seq)
+			seq = f.rateLimited(qctx, newQueryKey(driver, ds, metric.Query), f.metrics.rateLimited.MustCurryWith(labels), seq)
+			// an open circuit fails fast before waiting for limits, while only results
+			// of the driver are recorded by the breaker
+			if guard != nil {
+				seq = guard(seq)
+			}
+			// every attempt takes a token and a slot again, and stops retrying once the
+			// circuit opens
+			seq = retried(qctx, iface, policy, f.metrics.retries.MustCurryWith(labels), seq)
+			if shared {
+				rets, err, deduplicated := scrape.do(ctx, qkey, func() ([]types.Result, error) {
+					return Collect(seq)
+				})
+				if deduplicated {
+					f.metrics.deduplicated.With(labels).Inc()
+				}
+				seq = results(rets, err)
+			}
+			for ret, err := range seq {
+				if err != nil {
+					queryErr = err
+					break
+				}
+				rows++
+				if tracer != nil {
+					traced = append(traced, ret)
+				}
+				if sendErr = send(ret); sendErr != nil {
+					break
+				}
+			}
+			if queried {
+				f.metrics.queryDuration.With(labels).Observe(elapsed.Seconds())
+			}
+			f.metrics.rows.With(labels).Add(float64(rows))
+			if tracer != nil {
+				tracer(ds, query, traced, queryErr)
+			}
+			if queryErr != nil {
+				if metric.ContinueIfError {
+					logger.Error("failed to query", "datasource", dss, "metric", metric.String(), "err", queryErr)
+					return nil
+				}
+				return fmt.Errorf("failed to query %s with %s, err: %v", ds.String(), query, queryErr)
+			}
+			if sendErr != nil {
+				return sendErr
+			}
+			logger.Debug("", "datasource", dss, "metric", metric.String(), "rows", rows)
+			f.lastScrapes.set(key, now)
+			if rows == 0 && metric.AllowEmptyValue {
+				return send(types.Result{})
 			}
 			return nil
 		})
@@ -91,6 +254,29 @@ func (f *Factory) Process(ctx context.Context, logger *slog.Logger, namespace, d
 	return eg.Wait()
 }
 
+// Close closes clients of all queriers implementing Closer
+func (f *Factory) Close() error {
+	var errs []error
+	for _, driver := range f.Drivers() {
+		if closer, ok := f.queriers[driver].(Closer); ok {
+			if err := closer.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("failed to close driver %s, err: %v", driver, err))
+			}
+		}
+	}
+	return multierr.Combine(errs...)
+}
+
+// Drivers returns names of all registered drivers in sorted order
+func (f *Factory) Drivers() []string {
+	drivers := make([]string, 0, len(f.queriers))
+	for driver := range f.queriers {
+		drivers = append(drivers, driver)
+	}
+	sort.Strings(drivers)
+	return drivers
+}
+
 func (f *Factory) Register(driver string, iface Interface) {
 	if _, ok := Default.queriers[driver]; ok {
 		panic(fmt.Sprintf("driver %s duplicated", driver))
@@ -100,16 +286,19 @@ func (f *Factory) Register(driver string, iface Interface) {
 
 var Default = &Factory{
 	queriers: make(map[string]Interface),
+	metrics:  newMetrics(),
 }
 
-func Register(driver string, iface Interface) {
-	Default.Register(driver, iface)
+// New returns a factory querying through drivers registered in Default, with its own
+// self-metrics, concurrency limits, rate limits and circuit breakers, so that collectors
+// with different configs don't interfere with each other.
+func New() *Factory {
+	return &Factory{
+		queriers: Default.queriers,
+		metrics:  newMetrics(),
+	}
 }
 
-var defaultTpl *template.Template
-
-func init() {
-	defaultTpl = template.New("goTpl").
-		Option("missingkey=default").
-		Funcs(sprig.TxtFuncMap())
+func Register(driver string, iface Interface) {
+	Default.Register(driver, iface)
 }
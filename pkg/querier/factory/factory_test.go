@@ -0,0 +1,223 @@
+package factory
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+const fakeDriverName = "fake"
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// fakeDriver answers queries with query, counts queries by datasource and query,
+// and rejects queries mentioning invalid
+type fakeDriver struct {
+	query func(ctx context.Context, ds *types.DataSource, query string) ([]types.Result, error)
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (d *fakeDriver) Query(ctx context.Context, ds *types.DataSource, query string) ([]types.Result, error) {
+	d.mu.Lock()
+	if d.calls == nil {
+		d.calls = make(map[string]int)
+	}
+	d.calls[ds.String()+"/"+query]++
+	d.mu.Unlock()
+	return d.query(ctx, ds, query)
+}
+
+func (d *fakeDriver) Validate(_ *types.DataSource, query string) error {
+	if strings.Contains(query, "invalid") {
+		return errors.New("invalid query")
+	}
+	return nil
+}
+
+func (d *fakeDriver) callsOf(ds *types.DataSource, query string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.calls[ds.String()+"/"+query]
+}
+
+// newTestFactory returns a factory with iface registered as the fake driver
+func newTestFactory(iface Interface) *Factory {
+	return &Factory{
+		queriers: map[string]Interface{fakeDriverName: iface},
+		metrics:  newMetrics(),
+	}
+}
+
+// process runs metric against dss and returns the emitted metrics
+func process(ctx context.Context, f *Factory, dss []*types.DataSource, metric *types.MetricDesc) ([]prometheus.Metric, error) {
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	var metrics []prometheus.Metric
+	go func() {
+		defer close(done)
+		for m := range ch {
+			metrics = append(metrics, m)
+		}
+	}()
+	err := f.Process(ctx, discardLogger, "test", fakeDriverName, dss, metric, ch)
+	close(ch)
+	<-done
+	return metrics, err
+}
+
+// histogramOf returns samples observed by obs, a child of a histogram vector
+func histogramOf(t *testing.T, obs prometheus.Observer) *dto.Histogram {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := obs.(prometheus.Metric).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram()
+}
+
+func newDataSource(name string) *types.DataSource {
+	return &types.DataSource{Server: types.Server{Name: name}}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		driver  string
+		query   string
+		wantErr string
+	}{
+		{name: "valid", driver: fakeDriverName, query: `orders of {{ "primary" | upper }}`},
+		{name: "unknown driver", driver: "unknown", query: "orders", wantErr: "querier unknown not implemented yet"},
+		{name: "malformed template", driver: fakeDriverName, query: "orders of {{ .Vars ", wantErr: "failed to parse query of metric orders"},
+		{name: "unknown function", driver: fakeDriverName, query: "orders of {{ missing }}", wantErr: "failed to parse query of metric orders"},
+		{name: "rejected by driver", driver: fakeDriverName, query: "invalid orders", wantErr: "invalid query of metric orders for datasource primary"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestFactory(&fakeDriver{})
+			metric := &types.MetricDesc{Name: "orders", VariableValue: "value", Query: tt.query}
+			err := f.Validate(tt.driver, []*types.DataSource{newDataSource("primary")}, metric, nil)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProcessSelfMetrics(t *testing.T) {
+	tests := []struct {
+		name            string
+		rets            []types.Result
+		err             error
+		continueIfError bool
+		allowEmpty      bool
+		wantErr         bool
+		wantRows        float64
+		wantSeries      float64
+	}{
+		{name: "rows", rets: []types.Result{{"value": 1}, {"value": 2}}, wantRows: 2, wantSeries: 2},
+		{name: "empty", wantRows: 0, wantSeries: 0},
+		{name: "empty allowed", allowEmpty: true, wantRows: 0, wantSeries: 1},
+		{name: "failed", err: io.ErrUnexpectedEOF, wantErr: true},
+		{name: "failed and continued", err: io.ErrUnexpectedEOF, continueIfError: true},
+		{name: "row without value", rets: []types.Result{{"other": 1}, {"value": 2}}, continueIfError: true, wantRows: 2, wantSeries: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestFactory(&fakeDriver{query: func(ctx context.Context, _ *types.DataSource, _ string) ([]types.Result, error) {
+				AddBytesRead(ctx, 10)
+				return tt.rets, tt.err
+			}})
+			metric := &types.MetricDesc{Name: "orders", VariableValue: "value", Query: "orders", ContinueIfError: tt.continueIfError, AllowEmptyValue: tt.allowEmpty}
+			metrics, err := process(context.Background(), f, []*types.DataSource{newDataSource("primary")}, metric)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if len(metrics) != int(tt.wantSeries) {
+				t.Fatalf("got %d series, want %v", len(metrics), tt.wantSeries)
+			}
+			labels := []string{fakeDriverName, "primary", "orders"}
+			if got := testutil.ToFloat64(f.metrics.rows.WithLabelValues(labels...)); got != tt.wantRows {
+				t.Fatalf("got %v rows, want %v", got, tt.wantRows)
+			}
+			if got := testutil.ToFloat64(f.metrics.series.WithLabelValues(labels...)); got != tt.wantSeries {
+				t.Fatalf("got %v series counted, want %v", got, tt.wantSeries)
+			}
+			if got := testutil.ToFloat64(f.metrics.bytesRead.WithLabelValues(labels...)); got != 10 {
+				t.Fatalf("got %v bytes read, want 10", got)
+			}
+			if got := testutil.CollectAndCount(f.metrics.queryDuration); got != 1 {
+				t.Fatalf("got %d durations observed, want 1", got)
+			}
+		})
+	}
+}
+
+// fakeLifecycleDriver implements Driver on top of fakeDriver
+type fakeLifecycleDriver struct {
+	fakeDriver
+	opened, pinged int
+	err            error
+}
+
+func (d *fakeLifecycleDriver) Open(context.Context, *types.DataSource) error {
+	d.opened++
+	return d.err
+}
+
+func (d *fakeLifecycleDriver) Ping(context.Context, *types.DataSource) error {
+	d.pinged++
+	return d.err
+}
+
+func (d *fakeLifecycleDriver) Close() error {
+	return nil
+}
+
+var _ Driver = (*fakeLifecycleDriver)(nil)
+
+func TestOpenAndPing(t *testing.T) {
+	tests := []struct {
+		name        string
+		iface       Interface
+		wantOpenErr error
+		wantPingErr error
+	}{
+		{name: "query only driver", iface: &fakeDriver{}, wantPingErr: ErrNotSupported},
+		{name: "driver", iface: &fakeLifecycleDriver{}},
+		{name: "unreachable", iface: &fakeLifecycleDriver{err: io.ErrUnexpectedEOF}, wantOpenErr: io.ErrUnexpectedEOF, wantPingErr: io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestFactory(tt.iface)
+			ds := newDataSource("primary")
+			if err := f.Open(context.Background(), fakeDriverName, ds); !errors.Is(err, tt.wantOpenErr) {
+				t.Fatalf("got open error %v, want %v", err, tt.wantOpenErr)
+			}
+			if err := f.Ping(context.Background(), fakeDriverName, ds); !errors.Is(err, tt.wantPingErr) {
+				t.Fatalf("got ping error %v, want %v", err, tt.wantPingErr)
+			}
+			if err := f.Ping(context.Background(), "unknown", ds); err == nil {
+				t.Fatal("expected error of unknown driver")
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package factory
+
+import (
+	"context"
+	"iter"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/semaphore"
+
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+// limits bounds the number of in-flight queries, globally and per server. Queries
+// wait in FIFO order for a slot of their server first, then for a global slot, so
+// that global slots are not held by queries waiting on a busy server.
+type limits struct {
+	mu      sync.RWMutex
+	global  *semaphore.Weighted
+	servers map[string]*semaphore.Weighted
+}
+
+func (l *limits) get(server string) (global, perServer *semaphore.Weighted) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.global, l.servers[server]
+}
+
+// SetConcurrencyLimits sets the maximum number of in-flight queries of all servers and
+// of every server by name, zero means unlimited. It should be called before scraping.
+func (f *Factory) SetConcurrencyLimits(global int, servers map[string]int) {
+	f.limits.mu.Lock()
+	defer f.limits.mu.Unlock()
+	f.limits.global = nil
+	if global > 0 {
+		f.limits.global = semaphore.NewWeighted(int64(global))
+	}
+	f.limits.servers = make(map[string]*semaphore.Weighted, len(servers))
+	for server, n := range servers {
+		if n > 0 {
+			f.limits.servers[server] = semaphore.NewWeighted(int64(n))
+		}
+	}
+}
+
+// limited returns seq which waits for slots before the query starts and releases
+// them once all results are read.
+func (f *Factory) limited(ctx context.Context, ds *types.DataSource, wait prometheus.Observer, seq iter.Seq2[types.Result, error]) iter.Seq2[types.Result, error] {
+	global, perServer := f.limits.get(ds.Name)
+	if global == nil && perServer == nil {
+		return seq
+	}
+	return func(yield func(types.Result, error) bool) {
+		start := time.Now()
+		for _, sem := range []*semaphore.Weighted{perServer, global} {
+			if sem == nil {
+				continue
+			}
+			if err := sem.Acquire(ctx, 1); err != nil {
+				wait.Observe(time.Since(start).Seconds())
+				yield(nil, err)
+				return
+			}
+			defer sem.Release(1)
+		}
+		wait.Observe(time.Since(start).Seconds())
+		for ret, err := range seq {
+			if !yield(ret, err) {
+				return
+			}
+		}
+	}
+}
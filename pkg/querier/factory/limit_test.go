@@ -0,0 +1,109 @@
+package factory
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+// inflightDriver records the highest number of concurrent queries, in total and by server
+type inflightDriver struct {
+	fakeDriver
+
+	mu                 sync.Mutex
+	inflight, max      int
+	perServer, servers map[string]int
+}
+
+func newInflightDriver() *inflightDriver {
+	d := &inflightDriver{perServer: make(map[string]int), servers: make(map[string]int)}
+	d.query = func(_ context.Context, ds *types.DataSource, _ string) ([]types.Result, error) {
+		d.mu.Lock()
+		d.inflight++
+		d.max = max(d.max, d.inflight)
+		d.perServer[ds.Name]++
+		d.servers[ds.Name] = max(d.servers[ds.Name], d.perServer[ds.Name])
+		d.mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		d.mu.Lock()
+		d.inflight--
+		d.perServer[ds.Name]--
+		d.mu.Unlock()
+		return []types.Result{{"value": 1}}, nil
+	}
+	return d
+}
+
+func TestConcurrencyLimits(t *testing.T) {
+	tests := []struct {
+		name         string
+		global       int
+		servers      map[string]int
+		wantMax      int
+		wantServers  map[string]int
+		wantQueueing bool
+	}{
+		{name: "unlimited", wantMax: 6, wantServers: map[string]int{"primary": 3, "replica": 3}},
+		{name: "global", global: 2, wantMax: 2, wantServers: map[string]int{"primary": 2, "replica": 2}, wantQueueing: true},
+		{name: "per server", servers: map[string]int{"primary": 1}, wantMax: 6, wantServers: map[string]int{"primary": 1, "replica": 3}, wantQueueing: true},
+		{name: "both", global: 3, servers: map[string]int{"primary": 1, "replica": 1}, wantMax: 2, wantServers: map[string]int{"primary": 1, "replica": 1}, wantQueueing: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newInflightDriver()
+			f := newTestFactory(d)
+			f.SetConcurrencyLimits(tt.global, tt.servers)
+			var dss []*types.DataSource
+			for _, server := range []string{"primary", "replica"} {
+				for _, table := range []string{"orders", "users", "items"} {
+					ds := newDataSource(server)
+					ds.Table = table
+					dss = append(dss, ds)
+				}
+			}
+			metric := &types.MetricDesc{Name: "orders", VariableValue: "value", Query: "orders"}
+			metrics, err := process(context.Background(), f, dss, metric)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(metrics) != len(dss) {
+				t.Fatalf("got %d series, want %d", len(metrics), len(dss))
+			}
+			if d.max > tt.wantMax {
+				t.Fatalf("got %d concurrent queries, want at most %d", d.max, tt.wantMax)
+			}
+			for server, want := range tt.wantServers {
+				if got := d.servers[server]; got > want {
+					t.Fatalf("got %d concurrent queries against %s, want at most %d", got, server, want)
+				}
+			}
+			var waits uint64
+			for _, server := range []string{"primary", "replica"} {
+				waits += histogramOf(t, f.metrics.queueWait.WithLabelValues(fakeDriverName, server, "orders")).GetSampleCount()
+			}
+			if (waits > 0) != tt.wantQueueing {
+				t.Fatalf("got %d queue waits observed, want observed %v", waits, tt.wantQueueing)
+			}
+		})
+	}
+}
+
+func TestConcurrencyLimitCancelled(t *testing.T) {
+	f := newTestFactory(newInflightDriver())
+	f.SetConcurrencyLimits(1, nil)
+	global, _ := f.limits.get("primary")
+	if err := global.Acquire(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	defer global.Release(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	metric := &types.MetricDesc{Name: "orders", VariableValue: "value", Query: "orders"}
+	if _, err := process(ctx, f, []*types.DataSource{newDataSource("primary")}, metric); err == nil {
+		t.Fatal("expected error of query waiting for a slot beyond deadline")
+	}
+}
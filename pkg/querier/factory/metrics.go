@@ -0,0 +1,109 @@
+package factory
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics are self-metrics of queries, names are not prefixed by namespace so
+// that the registerer decides it.
+type metrics struct {
+	queryDuration *prometheus.HistogramVec
+	rows          *prometheus.CounterVec
+	series        *prometheus.CounterVec
+	bytesRead     *prometheus.CounterVec
+	deduplicated  *prometheus.CounterVec
+	queueWait     *prometheus.HistogramVec
+	rateLimited   *prometheus.CounterVec
+	breakerState  *prometheus.GaugeVec
+	retries       *prometheus.CounterVec
+}
+
+func newMetrics() *metrics {
+	labels := []string{"driver", "server", "metric"}
+	return &metrics{
+		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "query_duration_seconds",
+			Help:    "Latency of queries against datasources.",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		}, labels),
+		rows: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "query_rows_total",
+			Help: "Total rows returned by queries.",
+		}, labels),
+		series: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "query_series_total",
+			Help: "Total series emitted from query results.",
+		}, labels),
+		bytesRead: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "query_read_bytes_total",
+			Help: "Total bytes read from responses of datasources, only reported by drivers over HTTP.",
+		}, labels),
+		deduplicated: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "query_deduplicated_total",
+			Help: "Total queries not executed since an identical query of another metric was run within the same scrape.",
+		}, labels),
+		queueWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "query_queue_wait_seconds",
+			Help:    "Time queries waited for a slot of concurrency limits, only observed if limits are configured.",
+			Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		}, labels),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "query_rate_limited_total",
+			Help: "Total queries over the rate limit of their server, by whether they waited or were served from the last result.",
+		}, append(labels, "outcome")),
+		breakerState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "circuit_breaker_state",
+			Help: "State of the circuit breaker of servers, 0 is closed, 1 is open and 2 is half-open.",
+		}, []string{"server"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "query_retries_total",
+			Help: "Total retries of queries failed with transient errors, by class of the error.",
+		}, append(labels, "class")),
+	}
+}
+
+func (m *metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.queryDuration, m.rows, m.series, m.bytesRead, m.deduplicated, m.queueWait, m.rateLimited, m.breakerState, m.retries}
+}
+
+// collectors returns self-metrics of the factory, together with queriers
+// which implement prometheus.Collector, e.g. for connection pool statistics.
+func (f *Factory) collectors() []prometheus.Collector {
+	cs := f.metrics.collectors()
+	for _, driver := range f.Drivers() {
+		if c, ok := f.queriers[driver].(prometheus.Collector); ok {
+			cs = append(cs, c)
+		}
+	}
+	return cs
+}
+
+// Describe implements prometheus.Collector for self-metrics of the factory
+func (f *Factory) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range f.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector for self-metrics of the factory
+func (f *Factory) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range f.collectors() {
+		c.Collect(ch)
+	}
+}
+
+type bytesReadKey struct{}
+
+// AddBytesRead records n bytes read by the query running with ctx, it's a no-op
+// if ctx doesn't come from Process.
+func AddBytesRead(ctx context.Context, n int64) {
+	if c, ok := ctx.Value(bytesReadKey{}).(prometheus.Counter); ok {
+		c.Add(float64(n))
+	}
+}
+
+func withBytesRead(ctx context.Context, c prometheus.Counter) context.Context {
+	return context.WithValue(ctx, bytesReadKey{}, c)
+}
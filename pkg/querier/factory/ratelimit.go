@@ -0,0 +1,99 @@
+package factory
+
+import (
+	"context"
+	"iter"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+type rateLimiter struct {
+	limiter *rate.Limiter
+	policy  string
+}
+
+// rateLimits caps queries per second of servers, with the lastResult policy
+// results of queries are kept to serve queries over the limit. Results are keyed
+// by query templates instead of rendered queries, which change between scrapes,
+// so there is at most one entry for every metric and datasource of the config.
+type rateLimits struct {
+	mu       sync.RWMutex
+	servers  map[string]*rateLimiter
+	lastRets sync.Map // queryKey of the template -> []types.Result
+}
+
+func (l *rateLimits) get(server string) *rateLimiter {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.servers[server]
+}
+
+// SetRateLimits sets rate limits of servers by name, servers absent are unlimited.
+// It should be called before scraping.
+func (f *Factory) SetRateLimits(servers map[string]*types.RateLimit) {
+	f.rateLimits.mu.Lock()
+	defer f.rateLimits.mu.Unlock()
+	f.rateLimits.servers = make(map[string]*rateLimiter, len(servers))
+	f.rateLimits.lastRets.Clear()
+	for server, rl := range servers {
+		f.rateLimits.servers[server] = &rateLimiter{
+			limiter: rate.NewLimiter(rate.Limit(rl.QueriesPerSecond), rl.Burst),
+			policy:  rl.Policy,
+		}
+	}
+}
+
+// rateLimited returns seq which takes a token of the server before the query starts.
+// Over the limit, it either waits for a token, or yields the last results of the
+// same query template if the policy is lastResult and there are any.
+func (f *Factory) rateLimited(ctx context.Context, key queryKey, limited *prometheus.CounterVec, seq iter.Seq2[types.Result, error]) iter.Seq2[types.Result, error] {
+	rl := f.rateLimits.get(key.server)
+	if rl == nil {
+		return seq
+	}
+	return func(yield func(types.Result, error) bool) {
+		if !rl.limiter.Allow() {
+			if rl.policy == types.RateLimitPolicyLastResult {
+				if rets, ok := f.rateLimits.lastRets.Load(key); ok {
+					limited.WithLabelValues("last_result").Inc()
+					for ret := range results(rets.([]types.Result), nil) {
+						if !yield(ret, nil) {
+							return
+						}
+					}
+					return
+				}
+			}
+			limited.WithLabelValues("waited").Inc()
+			if err := rl.limiter.Wait(ctx); err != nil {
+				yield(nil, err)
+				return
+			}
+		}
+		if rl.policy != types.RateLimitPolicyLastResult {
+			for ret, err := range seq {
+				if !yield(ret, err) {
+					return
+				}
+			}
+			return
+		}
+		// only complete results are kept
+		var rets []types.Result
+		for ret, err := range seq {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			rets = append(rets, ret)
+			if !yield(ret, nil) {
+				return
+			}
+		}
+		f.rateLimits.lastRets.Store(key, rets)
+	}
+}
@@ -0,0 +1,74 @@
+package factory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+func TestRateLimits(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      string
+		query       string
+		scrapes     int
+		wantQueries int
+		wantLast    float64
+		wantErr     bool
+	}{
+		{name: "last result of static query", policy: types.RateLimitPolicyLastResult, query: "orders", scrapes: 3, wantQueries: 1, wantLast: 2},
+		{name: "last result of rendered query", policy: types.RateLimitPolicyLastResult, query: "orders since {{ .Now.UnixNano }}", scrapes: 3, wantQueries: 1, wantLast: 2},
+		{name: "wait beyond deadline", policy: types.RateLimitPolicyWait, query: "orders", scrapes: 2, wantQueries: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &fakeDriver{query: func(context.Context, *types.DataSource, string) ([]types.Result, error) {
+				return []types.Result{{"value": 1}}, nil
+			}}
+			f := newTestFactory(d)
+			f.SetRateLimits(map[string]*types.RateLimit{"primary": {QueriesPerSecond: 0.001, Burst: 1, Policy: tt.policy}})
+			ds := newDataSource("primary")
+			metric := &types.MetricDesc{Name: "orders", VariableValue: "value", Query: tt.query}
+
+			var err error
+			for i := 0; i < tt.scrapes; i++ {
+				ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+				metrics, perr := process(ctx, f, []*types.DataSource{ds}, metric)
+				cancel()
+				if perr != nil {
+					err = perr
+					continue
+				}
+				if len(metrics) != 1 {
+					t.Fatalf("got %d series of scrape %d, want 1", len(metrics), i)
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			queries := 0
+			for _, n := range d.calls {
+				queries += n
+			}
+			if queries != tt.wantQueries {
+				t.Fatalf("got %d queries, want %d", queries, tt.wantQueries)
+			}
+			if got := testutil.ToFloat64(f.metrics.rateLimited.WithLabelValues(fakeDriverName, "primary", "orders", "last_result")); got != tt.wantLast {
+				t.Fatalf("got %v queries served from last results, want %v", got, tt.wantLast)
+			}
+			entries := 0
+			f.rateLimits.lastRets.Range(func(any, any) bool {
+				entries++
+				return true
+			})
+			// rendered queries differ between scrapes, while results are kept once per template
+			if tt.policy == types.RateLimitPolicyLastResult && entries != 1 {
+				t.Fatalf("got %d last results kept, want 1", entries)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package factory
+
+import (
+	"context"
+	"errors"
+	"io"
+	"iter"
+	"net"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+// ErrorClassifier is implemented by queriers that tell transient errors from permanent
+// ones, Classify returns one of the types.ErrorClass constants. Errors classified as
+// permanent by queriers are still checked for common network errors.
+type ErrorClassifier interface {
+	Classify(err error) string
+}
+
+// classify returns the class of err, errors caused by the context are permanent
+// since retrying them can't succeed.
+func classify(iface Interface, err error) string {
+	if errors.Is(err, context.Canceled) || errors.Is(err, ErrCircuitOpen) {
+		return types.ErrorClassPermanent
+	}
+	if c, ok := iface.(ErrorClassifier); ok {
+		if class := c.Classify(err); class != types.ErrorClassPermanent {
+			return class
+		}
+	}
+	return ClassifyNetError(err)
+}
+
+// ClassifyNetError classifies common errors of network connections
+func ClassifyNetError(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return types.ErrorClassTimeout
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNABORTED), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		return types.ErrorClassConnection
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return types.ErrorClassConnection
+	}
+	return types.ErrorClassPermanent
+}
+
+// retried returns seq which is iterated again with backoff when it fails with an error
+// of a class to retry. Queries are only retried before any result is yielded, and
+// only if the backoff ends before the deadline of ctx and MaxElapsed of the policy.
+func retried(ctx context.Context, iface Interface, policy *types.RetryPolicy, retries *prometheus.CounterVec, seq iter.Seq2[types.Result, error]) iter.Seq2[types.Result, error] {
+	if policy == nil || policy.Attempts <= 1 {
+		return seq
+	}
+	return func(yield func(types.Result, error) bool) {
+		backoff := time.Duration(policy.InitialBackoff)
+		// giveUp is the earlier of the deadline of ctx and MaxElapsed, zero if neither is set
+		var giveUp time.Time
+		if policy.MaxElapsed > 0 {
+			giveUp = time.Now().Add(time.Duration(policy.MaxElapsed))
+		}
+		if deadline, ok := ctx.Deadline(); ok && (giveUp.IsZero() || deadline.Before(giveUp)) {
+			giveUp = deadline
+		}
+		for attempt := 1; ; attempt++ {
+			var (
+				yielded bool
+				failed  error
+			)
+			for ret, err := range seq {
+				if err != nil {
+					failed = err
+					break
+				}
+				yielded = true
+				if !yield(ret, nil) {
+					return
+				}
+			}
+			if failed == nil {
+				return
+			}
+			class := classify(iface, failed)
+			if yielded || attempt >= policy.Attempts || !slices.Contains(policy.RetryOn, class) {
+				yield(nil, failed)
+				return
+			}
+			if !giveUp.IsZero() && time.Until(giveUp) <= backoff {
+				yield(nil, failed)
+				return
+			}
+			retries.WithLabelValues(class).Inc()
+			timer := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				yield(nil, failed)
+				return
+			case <-timer.C:
+			}
+			backoff = min(backoff*2, time.Duration(policy.MaxBackoff))
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package factory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+// classifiedDriver classifies errors of throttled as throttled
+type classifiedDriver struct {
+	fakeDriver
+}
+
+var errThrottled = errors.New("too many requests")
+
+func (d *classifiedDriver) Classify(err error) string {
+	if errors.Is(err, errThrottled) {
+		return types.ErrorClassThrottled
+	}
+	return types.ErrorClassPermanent
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "classified by driver", err: fmt.Errorf("query: %w", errThrottled), want: types.ErrorClassThrottled},
+		{name: "connection refused", err: syscall.ECONNREFUSED, want: types.ErrorClassConnection},
+		{name: "network operation", err: &net.OpError{Op: "dial", Err: errors.New("no route to host")}, want: types.ErrorClassConnection},
+		{name: "deadline exceeded", err: context.DeadlineExceeded, want: types.ErrorClassTimeout},
+		{name: "cancelled", err: context.Canceled, want: types.ErrorClassPermanent},
+		{name: "circuit open", err: ErrCircuitOpen, want: types.ErrorClassPermanent},
+		{name: "other", err: errors.New("syntax error"), want: types.ErrorClassPermanent},
+	}
+	d := &classifiedDriver{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classify(d, tt.err); got != tt.want {
+				t.Fatalf("got class %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetried(t *testing.T) {
+	transient := syscall.ECONNRESET
+	tests := []struct {
+		name string
+		// errs are returned by attempts in turn, attempts beyond them succeed
+		errs    []error
+		policy  types.RetryPolicy
+		breaker *types.CircuitBreaker
+		// timeout of the scrape, zero means none
+		timeout      time.Duration
+		wantAttempts int
+		wantErr      string
+	}{
+		{name: "succeeds after transient errors", errs: []error{transient, errThrottled}, policy: types.RetryPolicy{Attempts: 3}, wantAttempts: 3},
+		{name: "permanent error not retried", errs: []error{errors.New("syntax error")}, policy: types.RetryPolicy{Attempts: 3}, wantAttempts: 1, wantErr: "syntax error"},
+		{name: "attempts exhausted", errs: []error{transient, transient, transient}, policy: types.RetryPolicy{Attempts: 2}, wantAttempts: 2, wantErr: "connection reset"},
+		{name: "class not retried", errs: []error{errThrottled}, policy: types.RetryPolicy{Attempts: 3, RetryOn: []string{types.ErrorClassConnection}}, wantAttempts: 1, wantErr: "too many requests"},
+		{name: "elapsed time capped", errs: []error{transient, transient}, policy: types.RetryPolicy{Attempts: 3, InitialBackoff: model.Duration(time.Second), MaxElapsed: model.Duration(100 * time.Millisecond)}, wantAttempts: 1, wantErr: "connection reset"},
+		{name: "backoff beyond deadline of scrape", errs: []error{transient, transient}, policy: types.RetryPolicy{Attempts: 3, InitialBackoff: model.Duration(time.Second)}, timeout: 100 * time.Millisecond, wantAttempts: 1, wantErr: "connection reset"},
+		{name: "stops once circuit opens", errs: []error{transient, transient}, policy: types.RetryPolicy{Attempts: 3}, breaker: &types.CircuitBreaker{FailureThreshold: 1, OpenTimeout: model.Duration(time.Minute)}, wantAttempts: 1, wantErr: ErrCircuitOpen.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			d := &classifiedDriver{}
+			d.query = func(context.Context, *types.DataSource, string) ([]types.Result, error) {
+				attempts++
+				if attempts <= len(tt.errs) {
+					return nil, tt.errs[attempts-1]
+				}
+				return []types.Result{{"value": 1}}, nil
+			}
+			f := newTestFactory(d)
+			// every attempt waits for a slot
+			f.SetConcurrencyLimits(1, nil)
+			if tt.breaker != nil {
+				f.SetCircuitBreakers(map[string]*types.CircuitBreaker{"primary": tt.breaker})
+			}
+			policy := tt.policy
+			if policy.InitialBackoff == 0 {
+				policy.InitialBackoff = model.Duration(time.Millisecond)
+			}
+			policy.MaxBackoff = max(policy.MaxBackoff, policy.InitialBackoff)
+			if len(policy.RetryOn) == 0 {
+				policy.RetryOn = types.TransientErrorClasses
+			}
+			metric := &types.MetricDesc{Name: "orders", VariableValue: "value", Query: "orders", Retry: &policy}
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			metrics, err := process(ctx, f, []*types.DataSource{newDataSource("primary")}, metric)
+			if tt.wantErr == "" {
+				if err != nil || len(metrics) != 1 {
+					t.Fatalf("got %d series and error %v, want 1 series", len(metrics), err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Fatalf("got %d attempts, want %d", attempts, tt.wantAttempts)
+			}
+			waits := histogramOf(t, f.metrics.queueWait.WithLabelValues(fakeDriverName, "primary", "orders")).GetSampleCount()
+			if tt.breaker == nil && waits != uint64(tt.wantAttempts) {
+				t.Fatalf("got %d waits for slots, want %d", waits, tt.wantAttempts)
+			}
+			var retries float64
+			for _, class := range types.TransientErrorClasses {
+				retries += testutil.ToFloat64(f.metrics.retries.WithLabelValues(fakeDriverName, "primary", "orders", class))
+			}
+			if want := tt.wantAttempts - 1; tt.breaker == nil && retries != float64(want) {
+				t.Fatalf("got %v retries, want %d", retries, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package factory
+
+import (
+	"context"
+	"iter"
+	"time"
+
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+// Streamer is implemented by queriers that yield results as they are read, so that
+// large results are turned into metrics without being buffered as a whole.
+// Iteration stops at the first error, which is yielded with a nil result, e.g. a row
+// that can't be scanned fails the query without reading the rows left. Metrics of
+// rows yielded before the error are already sent to the scrape.
+type Streamer interface {
+	Stream(ctx context.Context, ds *types.DataSource, query string) iter.Seq2[types.Result, error]
+}
+
+// stream returns results of query as a sequence, results of queriers not
+// implementing Streamer are buffered by Query.
+func stream(ctx context.Context, iface Interface, ds *types.DataSource, query string) iter.Seq2[types.Result, error] {
+	if s, ok := iface.(Streamer); ok {
+		return s.Stream(ctx, ds, query)
+	}
+	return func(yield func(types.Result, error) bool) {
+		rets, err := iface.Query(ctx, ds, query)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		for _, ret := range rets {
+			if !yield(ret, nil) {
+				return
+			}
+		}
+	}
+}
+
+// timed adds the time spent in seq to elapsed, while time spent by the consumer of
+// results, e.g. sending metrics to a slow scrape, is left out. It's only accessed by
+// the goroutine iterating the returned sequence.
+func timed(seq iter.Seq2[types.Result, error], elapsed *time.Duration, ran *bool) iter.Seq2[types.Result, error] {
+	return func(yield func(types.Result, error) bool) {
+		*ran = true
+		start := time.Now()
+		for ret, err := range seq {
+			*elapsed += time.Since(start)
+			if !yield(ret, err) {
+				return
+			}
+			start = time.Now()
+		}
+		*elapsed += time.Since(start)
+	}
+}
+
+// Collect buffers all results of seq, it's used by streaming queriers to implement Query
+func Collect(seq iter.Seq2[types.Result, error]) ([]types.Result, error) {
+	var rets []types.Result
+	for ret, err := range seq {
+		if err != nil {
+			return nil, err
+		}
+		rets = append(rets, ret)
+	}
+	return rets, nil
+}
@@ -0,0 +1,126 @@
+package factory
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+// fakeStreamer yields rets and then err, if any
+type fakeStreamer struct {
+	fakeDriver
+	rets  []types.Result
+	err   error
+	delay time.Duration
+}
+
+func (d *fakeStreamer) Stream(context.Context, *types.DataSource, string) iter.Seq2[types.Result, error] {
+	return func(yield func(types.Result, error) bool) {
+		for _, ret := range d.rets {
+			time.Sleep(d.delay)
+			if !yield(ret, nil) {
+				return
+			}
+		}
+		if d.err != nil {
+			yield(nil, d.err)
+		}
+	}
+}
+
+func TestProcessStream(t *testing.T) {
+	rows := []types.Result{{"value": 1}, {"value": 2}}
+	tests := []struct {
+		name       string
+		err        error
+		wantErr    bool
+		wantSeries int
+	}{
+		{name: "all rows", wantSeries: 2},
+		{name: "failed midway", err: errors.New("sql: Scan error on column index 0"), wantErr: true, wantSeries: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestFactory(&fakeStreamer{rets: rows, err: tt.err})
+			metric := &types.MetricDesc{Name: "orders", VariableValue: "value", Query: "orders"}
+			metrics, err := process(context.Background(), f, []*types.DataSource{newDataSource("primary")}, metric)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if len(metrics) != tt.wantSeries {
+				t.Fatalf("got %d series, want %d", len(metrics), tt.wantSeries)
+			}
+		})
+	}
+}
+
+func TestQueryDurationExcludesSends(t *testing.T) {
+	const (
+		delay     = 10 * time.Millisecond
+		sendDelay = 100 * time.Millisecond
+	)
+	tests := []struct {
+		name string
+		rets []types.Result
+	}{
+		{name: "single row", rets: []types.Result{{"value": 1}}},
+		{name: "several rows", rets: []types.Result{{"value": 1}, {"value": 2}, {"value": 3}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestFactory(&fakeStreamer{rets: tt.rets, delay: delay})
+			metric := &types.MetricDesc{Name: "orders", VariableValue: "value", Query: "orders"}
+			ch := make(chan prometheus.Metric)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for range ch {
+					time.Sleep(sendDelay)
+				}
+			}()
+			err := f.Process(context.Background(), discardLogger, "test", fakeDriverName, []*types.DataSource{newDataSource("primary")}, metric, ch)
+			close(ch)
+			<-done
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h := histogramOf(t, f.metrics.queryDuration.WithLabelValues(fakeDriverName, "primary", "orders"))
+			got := time.Duration(h.GetSampleSum() * float64(time.Second))
+			want := time.Duration(len(tt.rets)) * delay
+			if got < want || got >= want+sendDelay {
+				t.Fatalf("got query duration %v, want about %v", got, want)
+			}
+		})
+	}
+}
+
+func TestCollect(t *testing.T) {
+	rows := []types.Result{{"value": 1}, {"value": 2}}
+	tests := []struct {
+		name     string
+		err      error
+		wantRets int
+	}{
+		{name: "all rows", wantRets: 2},
+		{name: "failed midway", err: errors.New("sql: Scan error on column index 0")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &fakeStreamer{rets: rows, err: tt.err}
+			rets, err := Collect(d.Stream(context.Background(), newDataSource("primary"), "orders"))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if len(rets) != tt.wantRets {
+				t.Fatalf("got %d results, want %d", len(rets), tt.wantRets)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package factory
+
+import (
+	"bytes"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"github.com/Masterminds/sprig/v3"
+
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+// TemplateData is the data queries are rendered with, e.g.
+//
+//	select count(*) from {{ .DataSource.Table }} where created_at > '{{ .LastScrape.Format "2006-01-02 15:04:05" }}'
+type TemplateData struct {
+	DataSource TemplateDataSource
+	// Server is the name of the server
+	Server string
+	// Now is the time the scrape started
+	Now time.Time
+	// LastScrape is the time the last successful scrape of the metric against the
+	// datasource started, it's zero on the first scrape
+	LastScrape time.Time
+	// Interval is the window between LastScrape and Now, it's zero on the first scrape
+	Interval time.Duration
+	// Vars are the top-level vars of config
+	Vars map[string]any
+}
+
+// TemplateDataSource holds the fields of a datasource exposed to templates,
+// uri is left out to not leak credentials into queries.
+type TemplateDataSource struct {
+	Name     string
+	Database string
+	Table    string
+}
+
+func newTemplateData(ds *types.DataSource, now, lastScrape time.Time, vars map[string]any) *TemplateData {
+	data := &TemplateData{
+		DataSource: TemplateDataSource{Name: ds.Name, Database: ds.Database, Table: ds.Table},
+		Server:     ds.Name,
+		Now:        now,
+		LastScrape: lastScrape,
+		Vars:       vars,
+	}
+	if !lastScrape.IsZero() {
+		data.Interval = now.Sub(lastScrape)
+	}
+	return data
+}
+
+// scrapeKey identifies a metric of a datasource, several datasources of the same
+// server differ by database and table
+type scrapeKey struct {
+	driver, metric, server, database, table string
+}
+
+// lastScrapes records the start time of the last successful scrape of every
+// metric and datasource.
+type lastScrapes struct {
+	mu    sync.Mutex
+	times map[scrapeKey]time.Time
+}
+
+func (l *lastScrapes) get(key scrapeKey) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.times[key]
+}
+
+func (l *lastScrapes) set(key scrapeKey, t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.times == nil {
+		l.times = make(map[scrapeKey]time.Time)
+	}
+	l.times[key] = t
+}
+
+var bufPool = sync.Pool{
+	New: func() any {
+		return &bytes.Buffer{}
+	},
+}
+
+// compiledQuery is a query template parsed once and shared by all scrapes
+type compiledQuery struct {
+	tpl *template.Template
+	// static is set if the query has no actions, it's used as is without rendering
+	static bool
+}
+
+// queryCache holds compiled templates keyed by query text, so metrics sharing the
+// same query share a template as well.
+type queryCache struct {
+	queries sync.Map
+}
+
+func (c *queryCache) compile(query string) (*compiledQuery, error) {
+	if q, ok := c.queries.Load(query); ok {
+		return q.(*compiledQuery), nil
+	}
+	tp, err := defaultTpl.Clone()
+	if err != nil {
+		return nil, err
+	}
+	if tp, err = tp.Parse(query); err != nil {
+		return nil, err
+	}
+	q, _ := c.queries.LoadOrStore(query, &compiledQuery{tpl: tp, static: isStatic(tp)})
+	return q.(*compiledQuery), nil
+}
+
+func isStatic(tp *template.Template) bool {
+	if tp.Tree == nil || tp.Tree.Root == nil {
+		return true
+	}
+	for _, node := range tp.Tree.Root.Nodes {
+		if node.Type() != parse.NodeText {
+			return false
+		}
+	}
+	return true
+}
+
+func render(tp *template.Template, data any) (string, error) {
+	buf := bufPool.Get().(*bytes.Buffer)
+	defer func() {
+		buf.Reset()
+		bufPool.Put(buf)
+	}()
+	if err := tp.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+var defaultTpl *template.Template
+
+func init() {
+	defaultTpl = template.New("goTpl").
+		Option("missingkey=default").
+		Funcs(sprig.TxtFuncMap())
+}
@@ -0,0 +1,127 @@
+package factory
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		vars    map[string]any
+		scrapes int
+		want    string
+	}{
+		{name: "datasource", query: "{{ .Server }} {{ .DataSource.Database }} {{ .DataSource.Table }}", scrapes: 1, want: "primary shop orders"},
+		{name: "vars", query: "{{ .Vars.status }}", vars: map[string]any{"status": "paid"}, scrapes: 1, want: "paid"},
+		{name: "missing vars", query: "{{ .Vars.status }}", scrapes: 1, want: "<no value>"},
+		{name: "first scrape", query: "{{ .LastScrape.IsZero }} {{ .Interval }}", scrapes: 1, want: "true 0s"},
+		{name: "following scrape", query: "{{ .LastScrape.IsZero }} {{ .LastScrape.Before .Now }}", scrapes: 2, want: "false true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu    sync.Mutex
+				query string
+			)
+			f := newTestFactory(&fakeDriver{query: func(_ context.Context, _ *types.DataSource, q string) ([]types.Result, error) {
+				mu.Lock()
+				query = q
+				mu.Unlock()
+				return []types.Result{{"value": 1}}, nil
+			}})
+			ds := newDataSource("primary")
+			ds.Database, ds.Table = "shop", "orders"
+			metric := &types.MetricDesc{Name: "orders", VariableValue: "value", Query: tt.query}
+			for range tt.scrapes {
+				if _, err := process(WithVars(context.Background(), tt.vars), f, []*types.DataSource{ds}, metric); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if query != tt.want {
+				t.Fatalf("got query %q, want %q", query, tt.want)
+			}
+		})
+	}
+}
+
+func TestLastScrapePerDataSource(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		queries = make(map[string]string)
+	)
+	f := newTestFactory(&fakeDriver{query: func(_ context.Context, ds *types.DataSource, query string) ([]types.Result, error) {
+		mu.Lock()
+		queries[ds.Database] = query
+		mu.Unlock()
+		if ds.Database == "broken" {
+			return nil, errors.New("no such database")
+		}
+		return []types.Result{{"value": 1}}, nil
+	}})
+	ok, broken := newDataSource("primary"), newDataSource("primary")
+	ok.Database, broken.Database = "orders", "broken"
+	metric := &types.MetricDesc{Name: "orders", VariableValue: "value", Query: "{{ .LastScrape.IsZero }}", ContinueIfError: true}
+
+	tests := []struct {
+		name string
+		want map[string]string
+	}{
+		{name: "first scrape", want: map[string]string{"orders": "true", "broken": "true"}},
+		{name: "only successful datasource recorded", want: map[string]string{"orders": "false", "broken": "true"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := process(context.Background(), f, []*types.DataSource{ok, broken}, metric); err != nil {
+				t.Fatal(err)
+			}
+			for database, want := range tt.want {
+				if got := queries[database]; got != want {
+					t.Fatalf("got query %q of database %s, want %q", got, database, want)
+				}
+			}
+		})
+	}
+}
+
+func TestQueryCache(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		wantStatic bool
+		wantErr    bool
+	}{
+		{name: "static", query: "SELECT count(*) AS value FROM orders", wantStatic: true},
+		{name: "empty", query: "", wantStatic: true},
+		{name: "action", query: "SELECT count(*) AS value FROM {{ .DataSource.Table }}"},
+		{name: "comment", query: "SELECT 1 {{/* comment */}}", wantStatic: true},
+		{name: "malformed", query: "SELECT {{ .Vars.key ", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c queryCache
+			q, err := c.compile(tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if q.static != tt.wantStatic {
+				t.Fatalf("got static %v, want %v", q.static, tt.wantStatic)
+			}
+			again, err := c.compile(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again != q {
+				t.Fatal("expected compiled query to be cached")
+			}
+		})
+	}
+}
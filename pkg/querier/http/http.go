@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
@@ -13,6 +15,7 @@ import (
 
 	"sigs.k8s.io/yaml"
 
+	"github.com/fengxsong/queryexporter/pkg/querier/conn"
 	"github.com/fengxsong/queryexporter/pkg/querier/factory"
 	"github.com/fengxsong/queryexporter/pkg/types"
 )
@@ -20,7 +23,62 @@ import (
 const name = "http"
 
 type httpDriver struct {
-	client *http.Client
+	clients *conn.Manager[*http.Client]
+}
+
+func newDriver() *httpDriver {
+	return &httpDriver{clients: conn.New(conn.Options[*http.Client]{
+		Open: open,
+		Close: func(c *http.Client) error {
+			c.CloseIdleConnections()
+			return nil
+		},
+	})}
+}
+
+// open creates a client with its own transport per server, so that connections
+// of a server can be limited by pool settings and released once it's evicted.
+func open(_ context.Context, ds *types.DataSource) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if pool := ds.Pool; pool != nil {
+		if pool.MaxOpen > 0 {
+			transport.MaxConnsPerHost = pool.MaxOpen
+		}
+		if pool.MaxIdle > 0 {
+			transport.MaxIdleConnsPerHost = pool.MaxIdle
+		}
+		if pool.MaxIdleTime > 0 {
+			transport.IdleConnTimeout = time.Duration(pool.MaxIdleTime)
+		}
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+func (d *httpDriver) Open(ctx context.Context, ds *types.DataSource) error {
+	return d.clients.Open(ctx, ds)
+}
+
+// Ping sends a HEAD request to the uri of the datasource, any response means
+// the server is reachable.
+func (d *httpDriver) Ping(ctx context.Context, ds *types.DataSource) error {
+	if ds.URI == "" {
+		return factory.ErrNotSupported
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodHead, ds.URI, nil)
+	if err != nil {
+		return err
+	}
+	return d.clients.Peek(ctx, ds, func(client *http.Client) error {
+		resp, err := client.Do(r)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	})
+}
+
+func (d *httpDriver) Close() error {
+	return d.clients.Close()
 }
 
 // parse query into request
@@ -33,10 +91,11 @@ type request struct {
 	Timeout time.Duration `json:"timeout"`
 }
 
-func (d *httpDriver) Query(ctx context.Context, ds *types.DataSource, query string) ([]types.Result, error) {
+// newRequest parses query into request, and resolves relative uri against the datasource
+func newRequest(ds *types.DataSource, query string) (*request, *http.Request, error) {
 	var req request
 	if err := yaml.Unmarshal([]byte(query), &req); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if req.Method == "" {
 		req.Method = http.MethodGet
@@ -47,18 +106,21 @@ func (d *httpDriver) Query(ctx context.Context, ds *types.DataSource, query stri
 	} else if len(ds.URI) > 0 {
 		u, err := url.Parse(ds.URI)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		u.Path = path.Join(u.Path, req.URI)
 		rawURL = u.String()
 	}
+	if rawURL == "" {
+		return nil, nil, fmt.Errorf("cannot resolve absolute uri of %q", req.URI)
+	}
 	var body io.Reader
 	if len(req.Body) > 0 {
 		body = bytes.NewBufferString(req.Body)
 	}
 	r, err := http.NewRequest(req.Method, rawURL, body)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if len(req.Token) > 0 {
 		r.Header.Set("Authorization", req.Token)
@@ -66,23 +128,91 @@ func (d *httpDriver) Query(ctx context.Context, ds *types.DataSource, query stri
 	if len(req.Headers) > 0 {
 		r.Header = req.Headers.Clone()
 	}
+	return &req, r, nil
+}
+
+func (d *httpDriver) Validate(ds *types.DataSource, query string) error {
+	_, _, err := newRequest(ds, query)
+	return err
+}
+
+func (d *httpDriver) Query(ctx context.Context, ds *types.DataSource, query string) ([]types.Result, error) {
+	req, r, err := newRequest(ds, query)
+	if err != nil {
+		return nil, err
+	}
 	if req.Timeout > 0 {
-		ctx, cancel := context.WithTimeout(ctx, req.Timeout)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, req.Timeout)
 		defer cancel()
-		r = r.WithContext(ctx)
 	}
-	resp, err := d.client.Do(r)
+	r = r.WithContext(ctx)
+	var rets []types.Result
+	err = d.clients.Do(ctx, ds, func(client *http.Client) (err error) {
+		rets, err = doRequest(ctx, client, r)
+		return err
+	})
+	return rets, err
+}
+
+func doRequest(ctx context.Context, client *http.Client, r *http.Request) ([]types.Result, error) {
+	resp, err := client.Do(r)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	body := &countingReader{r: resp.Body}
+	defer func() {
+		factory.AddBytesRead(ctx, body.n)
+	}()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(body, 256))
+		return nil, &statusError{code: resp.StatusCode, status: resp.Status, body: string(bytes.TrimSpace(msg))}
+	}
 	var rets []types.Result
-	if err = json.NewDecoder(resp.Body).Decode(&rets); err != nil {
+	if err = json.NewDecoder(body).Decode(&rets); err != nil {
 		return nil, err
 	}
 	return rets, nil
 }
 
+type statusError struct {
+	code   int
+	status string
+	body   string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("server returned HTTP status %s: %s", e.status, e.body)
+}
+
+// Classify implements factory.ErrorClassifier
+func (d *httpDriver) Classify(err error) string {
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		switch {
+		case statusErr.code == http.StatusTooManyRequests:
+			return types.ErrorClassThrottled
+		case statusErr.code/100 == 5:
+			return types.ErrorClassUnavailable
+		}
+	}
+	return types.ErrorClassPermanent
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+var _ factory.Driver = (*httpDriver)(nil)
+
 func init() {
-	factory.Register(name, &httpDriver{http.DefaultClient})
+	factory.Register(name, newDriver())
 }
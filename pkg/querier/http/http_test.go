@@ -0,0 +1,43 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		status int
+		want   string
+	}{
+		{status: http.StatusTooManyRequests, want: types.ErrorClassThrottled},
+		{status: http.StatusInternalServerError, want: types.ErrorClassUnavailable},
+		{status: http.StatusServiceUnavailable, want: types.ErrorClassUnavailable},
+		{status: http.StatusNotFound, want: types.ErrorClassPermanent},
+		{status: http.StatusUnauthorized, want: types.ErrorClassPermanent},
+	}
+	d := newDriver()
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "failed", tt.status)
+			}))
+			defer srv.Close()
+			ds := &types.DataSource{Server: types.Server{Name: "api", URI: srv.URL}}
+			_, err := d.Query(context.Background(), ds, "uri: /orders")
+			var statusErr *statusError
+			if !errors.As(err, &statusErr) || statusErr.code != tt.status {
+				t.Fatalf("got error %v, want status %d", err, tt.status)
+			}
+			if got := d.Classify(fmt.Errorf("failed to query: %w", err)); got != tt.want {
+				t.Fatalf("got class %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,13 +2,18 @@ package mongo
 
 import (
 	"context"
-	"sync"
+	"errors"
+	"iter"
+	"sync/atomic"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/event"
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
-	"go.uber.org/multierr"
 
+	"github.com/fengxsong/queryexporter/pkg/querier/conn"
 	"github.com/fengxsong/queryexporter/pkg/querier/factory"
 	"github.com/fengxsong/queryexporter/pkg/querier/log"
 	"github.com/fengxsong/queryexporter/pkg/types"
@@ -17,66 +22,226 @@ import (
 const name = "mongo"
 
 type mongoDriver struct {
-	cached sync.Map
+	clients *conn.Manager[*client]
 }
 
-func (d *mongoDriver) getCachedClient(uri string) (*mongo.Client, error) {
-	val, ok := d.cached.Load(uri)
-	if ok {
-		return val.(*mongo.Client), nil
+func newDriver() *mongoDriver {
+	return &mongoDriver{clients: conn.New(conn.Options[*client]{
+		Open:        open,
+		Close:       (*client).close,
+		IsAuthError: isAuthError,
+	})}
+}
+
+// poolStats are counted from connection pool events, since the driver doesn't
+// expose statistics of the pool directly.
+type poolStats struct {
+	created, closed, checkedOut, checkedIn, checkOutFailed atomic.Int64
+}
+
+func (s *poolStats) event(e *event.PoolEvent) {
+	switch e.Type {
+	case event.ConnectionCreated:
+		s.created.Add(1)
+	case event.ConnectionClosed:
+		s.closed.Add(1)
+	case event.ConnectionCheckedOut:
+		s.checkedOut.Add(1)
+	case event.ConnectionCheckedIn:
+		s.checkedIn.Add(1)
+	case event.ConnectionCheckOutFailed:
+		s.checkOutFailed.Add(1)
 	}
+}
+
+type client struct {
+	*mongo.Client
+	stats *poolStats
+}
 
-	client, err := mongo.Connect(options.Client().ApplyURI(uri))
+func open(_ context.Context, ds *types.DataSource) (*client, error) {
+	stats := &poolStats{}
+	opts := options.Client().ApplyURI(ds.URI).SetPoolMonitor(&event.PoolMonitor{Event: stats.event})
+	if pool := ds.Pool; pool != nil {
+		if pool.MaxOpen > 0 {
+			opts.SetMaxPoolSize(uint64(pool.MaxOpen))
+		}
+		if pool.MaxIdleTime > 0 {
+			opts.SetMaxConnIdleTime(time.Duration(pool.MaxIdleTime))
+		}
+	}
+	c, err := mongo.Connect(opts)
 	if err != nil {
 		return nil, err
 	}
-	d.cached.Store(uri, client)
-	return client, nil
+	return &client{Client: c, stats: stats}, nil
 }
 
-func (d *mongoDriver) aggregate(ctx context.Context, uri, db, col string, pipeline bson.A) (*mongo.Cursor, error) {
-	client, err := d.getCachedClient(uri)
-	if err != nil {
-		return nil, err
+// disconnectTimeout bounds the time waiting for in use connections on Close
+const disconnectTimeout = 10 * time.Second
+
+func (c *client) close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), disconnectTimeout)
+	defer cancel()
+	return c.Disconnect(ctx)
+}
+
+func isAuthError(err error) bool {
+	var serverErr mongo.ServerError
+	// AuthenticationFailed
+	return errors.As(err, &serverErr) && serverErr.HasErrorCode(18)
+}
+
+// classes of server error codes, see
+// https://github.com/mongodb/mongo/blob/master/src/mongo/base/error_codes.yml
+var codeClasses = []struct {
+	class string
+	codes []int
+}{
+	// HostUnreachable, HostNotFound
+	{class: types.ErrorClassConnection, codes: []int{6, 7}},
+	// MaxTimeMSExpired, NetworkTimeout, ExceededTimeLimit
+	{class: types.ErrorClassTimeout, codes: []int{50, 89, 262}},
+	// ShutdownInProgress, PrimarySteppedDown, NotWritablePrimary, InterruptedAtShutdown,
+	// InterruptedDueToReplStateChange, NotPrimaryNoSecondaryOk, NotPrimaryOrSecondary
+	{class: types.ErrorClassUnavailable, codes: []int{91, 189, 10107, 11600, 11602, 13435, 13436}},
+}
+
+// Classify implements factory.ErrorClassifier, errors labeled as retryable by servers
+// are transient whatever their codes, codes are only looked at for unlabeled errors.
+func (d *mongoDriver) Classify(err error) string {
+	var labeled mongo.LabeledError
+	switch {
+	case mongo.IsTimeout(err):
+		return types.ErrorClassTimeout
+	case mongo.IsNetworkError(err):
+		return types.ErrorClassConnection
+	case errors.As(err, &labeled) && (labeled.HasErrorLabel("RetryableWriteError") ||
+		labeled.HasErrorLabel("TransientTransactionError")):
+		return types.ErrorClassUnavailable
 	}
-	return client.Database(db).Collection(col).Aggregate(ctx, pipeline)
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) {
+		for _, cc := range codeClasses {
+			for _, code := range cc.codes {
+				if serverErr.HasErrorCode(code) {
+					return cc.class
+				}
+			}
+		}
+	}
+	return types.ErrorClassPermanent
 }
 
-func (d *mongoDriver) Query(ctx context.Context, ds *types.DataSource, query string) ([]types.Result, error) {
+func (d *mongoDriver) Open(ctx context.Context, ds *types.DataSource) error {
+	return d.clients.Open(ctx, ds)
+}
+
+func (d *mongoDriver) Ping(ctx context.Context, ds *types.DataSource) error {
+	return d.clients.Peek(ctx, ds, func(c *client) error {
+		return c.Ping(ctx, nil)
+	})
+}
+
+func (d *mongoDriver) Close() error {
+	return d.clients.Close()
+}
+
+func parsePipeline(query string) (bson.A, error) {
 	var pipeline bson.A
 	if err := bson.UnmarshalExtJSON([]byte(query), false, &pipeline); err != nil {
 		return nil, err
 	}
-	logger := log.GetLogger(ctx)
-	logger.Debug("query", "pipeline", pipeline)
+	return pipeline, nil
+}
 
-	cur, err := d.aggregate(ctx, ds.URI, ds.Database, ds.Table, pipeline)
-	if err != nil {
-		return nil, err
+func (d *mongoDriver) Validate(ds *types.DataSource, query string) error {
+	if ds.Database == "" || ds.Table == "" {
+		return errors.New("both database and table are required for aggregation")
 	}
-	var (
-		errs = make([]error, 0)
-		rets = make([]types.Result, 0)
-	)
-	for cur.Next(ctx) {
-		ret := make(types.Result)
-		err = cur.Decode(&ret)
+	_, err := parsePipeline(query)
+	return err
+}
+
+func (d *mongoDriver) Query(ctx context.Context, ds *types.DataSource, query string) ([]types.Result, error) {
+	return factory.Collect(d.Stream(ctx, ds, query))
+}
+
+// Stream yields documents of the aggregation as they are read from the cursor
+func (d *mongoDriver) Stream(ctx context.Context, ds *types.DataSource, query string) iter.Seq2[types.Result, error] {
+	return func(yield func(types.Result, error) bool) {
+		pipeline, err := parsePipeline(query)
 		if err != nil {
-			errs = append(errs, err)
-			continue
+			yield(nil, err)
+			return
+		}
+		logger := log.GetLogger(ctx)
+		logger.Debug("query", "pipeline", pipeline)
+
+		var cur *mongo.Cursor
+		release, err := d.clients.Borrow(ctx, ds, func(c *client) (err error) {
+			cur, err = c.Database(ds.Database).Collection(ds.Table).Aggregate(ctx, pipeline)
+			return err
+		})
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		defer release()
+		defer cur.Close(ctx)
+		for cur.Next(ctx) {
+			ret := make(types.Result)
+			if err = cur.Decode(&ret); err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(ret, nil) {
+				return
+			}
+		}
+		if err = cur.Err(); err != nil {
+			yield(nil, err)
 		}
-		rets = append(rets, ret)
-	}
-	if len(errs) > 0 {
-		return nil, multierr.Combine(errs...)
 	}
-	return rets, nil
 }
 
 func (d *mongoDriver) Name() string {
 	return name
 }
 
+var (
+	poolLabels             = []string{"server"}
+	poolOpenDesc           = prometheus.NewDesc("mongo_pool_open_connections", "Number of open connections in the pool.", poolLabels, nil)
+	poolInUseDesc          = prometheus.NewDesc("mongo_pool_in_use_connections", "Number of connections checked out of the pool.", poolLabels, nil)
+	poolCreatedDesc        = prometheus.NewDesc("mongo_pool_connections_created_total", "Total number of connections created.", poolLabels, nil)
+	poolClosedDesc         = prometheus.NewDesc("mongo_pool_connections_closed_total", "Total number of connections closed.", poolLabels, nil)
+	poolCheckOutFailedDesc = prometheus.NewDesc("mongo_pool_checkout_failures_total", "Total number of failed attempts to check out a connection.", poolLabels, nil)
+)
+
+// Describe implements prometheus.Collector for statistics of connection pools
+func (d *mongoDriver) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolOpenDesc
+	ch <- poolInUseDesc
+	ch <- poolCreatedDesc
+	ch <- poolClosedDesc
+	ch <- poolCheckOutFailedDesc
+}
+
+// Collect implements prometheus.Collector for statistics of connection pools
+func (d *mongoDriver) Collect(ch chan<- prometheus.Metric) {
+	d.clients.Range(func(server string, c *client) {
+		created, closed := c.stats.created.Load(), c.stats.closed.Load()
+		checkedOut, checkedIn := c.stats.checkedOut.Load(), c.stats.checkedIn.Load()
+		ch <- prometheus.MustNewConstMetric(poolOpenDesc, prometheus.GaugeValue, float64(created-closed), server)
+		ch <- prometheus.MustNewConstMetric(poolInUseDesc, prometheus.GaugeValue, float64(checkedOut-checkedIn), server)
+		ch <- prometheus.MustNewConstMetric(poolCreatedDesc, prometheus.CounterValue, float64(created), server)
+		ch <- prometheus.MustNewConstMetric(poolClosedDesc, prometheus.CounterValue, float64(closed), server)
+		ch <- prometheus.MustNewConstMetric(poolCheckOutFailedDesc, prometheus.CounterValue, float64(c.stats.checkOutFailed.Load()), server)
+	})
+}
+
+var _ factory.Driver = (*mongoDriver)(nil)
+
 func init() {
-	factory.Register(name, &mongoDriver{})
+	factory.Register(name, newDriver())
 }
@@ -0,0 +1,42 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/mongo"
+
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "deadline exceeded", err: context.DeadlineExceeded, want: types.ErrorClassTimeout},
+		{name: "network error label", err: mongo.CommandError{Code: 0, Labels: []string{"NetworkError"}}, want: types.ErrorClassConnection},
+		{name: "host unreachable", err: mongo.CommandError{Code: 6, Name: "HostUnreachable"}, want: types.ErrorClassConnection},
+		{name: "max time expired", err: mongo.CommandError{Code: 50, Name: "MaxTimeMSExpired"}, want: types.ErrorClassTimeout},
+		{name: "exceeded time limit", err: mongo.CommandError{Code: 262, Name: "ExceededTimeLimit"}, want: types.ErrorClassTimeout},
+		{name: "shutdown in progress", err: mongo.CommandError{Code: 91, Name: "ShutdownInProgress"}, want: types.ErrorClassUnavailable},
+		{name: "primary stepped down", err: mongo.CommandError{Code: 189, Name: "PrimarySteppedDown"}, want: types.ErrorClassUnavailable},
+		{name: "not writable primary", err: fmt.Errorf("aggregate: %w", mongo.CommandError{Code: 10107, Name: "NotWritablePrimary"}), want: types.ErrorClassUnavailable},
+		{name: "retryable write label", err: mongo.CommandError{Code: 2, Name: "BadValue", Labels: []string{"RetryableWriteError"}}, want: types.ErrorClassUnavailable},
+		{name: "transient transaction label", err: mongo.CommandError{Code: 112, Name: "WriteConflict", Labels: []string{"TransientTransactionError"}}, want: types.ErrorClassUnavailable},
+		{name: "label before code", err: mongo.CommandError{Code: 7, Name: "HostNotFound", Labels: []string{"RetryableWriteError"}}, want: types.ErrorClassUnavailable},
+		{name: "invalid pipeline", err: mongo.CommandError{Code: 40324, Name: "Location40324"}, want: types.ErrorClassPermanent},
+		{name: "other", err: errors.New("no such collection"), want: types.ErrorClassPermanent},
+	}
+	d := newDriver()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := d.Classify(tt.err); got != tt.want {
+				t.Fatalf("got class %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -4,10 +4,12 @@ import (
 	"context"
 	"fmt"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
 
+	"github.com/fengxsong/queryexporter/pkg/querier/conn"
 	"github.com/fengxsong/queryexporter/pkg/querier/factory"
 	"github.com/fengxsong/queryexporter/pkg/types"
 )
@@ -18,60 +20,165 @@ const (
 )
 
 type redisDriver struct {
-	cached sync.Map
+	clients *conn.Manager[*redis.Client]
 }
 
-func (d *redisDriver) getCachedClient(uri string) (*redis.Client, error) {
-	val, ok := d.cached.Load(uri)
-	if ok {
-		return val.(*redis.Client), nil
-	}
-	opts, err := redis.ParseURL(uri)
+func newDriver() *redisDriver {
+	return &redisDriver{clients: conn.New(conn.Options[*redis.Client]{
+		Open:        open,
+		Close:       (*redis.Client).Close,
+		IsAuthError: isAuthError,
+	})}
+}
+
+func open(_ context.Context, ds *types.DataSource) (*redis.Client, error) {
+	opts, err := redis.ParseURL(ds.URI)
 	if err != nil {
 		return nil, err
 	}
-	client := redis.NewClient(opts)
-	d.cached.Store(uri, client)
-	return client, nil
+	if pool := ds.Pool; pool != nil {
+		if pool.MaxOpen > 0 {
+			opts.PoolSize = pool.MaxOpen
+		}
+		if pool.MaxLifetime > 0 {
+			opts.MaxConnAge = time.Duration(pool.MaxLifetime)
+		}
+		if pool.MaxIdleTime > 0 {
+			opts.IdleTimeout = time.Duration(pool.MaxIdleTime)
+		}
+	}
+	return redis.NewClient(opts), nil
 }
 
-func (d *redisDriver) Query(ctx context.Context, ds *types.DataSource, query string) ([]types.Result, error) {
-	client, err := d.getCachedClient(ds.URI)
-	if err != nil {
-		return nil, err
+func isAuthError(err error) bool {
+	msg := err.Error()
+	return strings.HasPrefix(msg, "WRONGPASS") || strings.HasPrefix(msg, "NOAUTH")
+}
+
+// Classify implements factory.ErrorClassifier
+func (d *redisDriver) Classify(err error) string {
+	msg := err.Error()
+	for _, prefix := range []string{"LOADING", "BUSY", "TRYAGAIN", "CLUSTERDOWN", "MASTERDOWN"} {
+		if strings.HasPrefix(msg, prefix) {
+			return types.ErrorClassUnavailable
+		}
 	}
-	return doQuery(ctx, client, query)
+	return types.ErrorClassPermanent
 }
 
-func doQuery(ctx context.Context, client *redis.Client, query string) ([]types.Result, error) {
-	parts := strings.Split(query, " ")
+func (d *redisDriver) Open(ctx context.Context, ds *types.DataSource) error {
+	return d.clients.Open(ctx, ds)
+}
+
+func (d *redisDriver) Query(ctx context.Context, ds *types.DataSource, query string) ([]types.Result, error) {
+	var rets []types.Result
+	err := d.clients.Do(ctx, ds, func(client *redis.Client) (err error) {
+		rets, err = doQuery(ctx, client, query)
+		return err
+	})
+	return rets, err
+}
+
+func (d *redisDriver) Ping(ctx context.Context, ds *types.DataSource) error {
+	return d.clients.Peek(ctx, ds, func(client *redis.Client) error {
+		return client.Ping(ctx).Err()
+	})
+}
+
+func (d *redisDriver) Close() error {
+	return d.clients.Close()
+}
+
+// parseCommand splits query into command and arguments, and checks the number of arguments
+func parseCommand(query string) (string, []string, error) {
+	parts := strings.Fields(query)
 	if len(parts) >= 2 {
-		switch strings.ToLower(parts[0]) {
-		case "get":
-			res, err := client.Get(ctx, parts[1]).Result()
-			return []types.Result{{valueKeyName: res}}, err
+		cmd := strings.ToLower(parts[0])
+		switch cmd {
+		case "get", "hgetall":
+			if len(parts) != 2 {
+				return "", nil, fmt.Errorf("unknown %s command: %v", cmd, query)
+			}
+			return cmd, parts[1:], nil
 		case "hget":
 			if len(parts) != 3 {
-				return nil, fmt.Errorf("unknown hget command: %v", query)
-			}
-			res, err := client.HGet(ctx, parts[1], parts[2]).Result()
-			return []types.Result{{valueKeyName: res}}, err
-		case "hgetall":
-			res := client.HGetAll(ctx, parts[1])
-			if res.Err() != nil {
-				return nil, res.Err()
-			}
-			var ret types.Result
-			if err := res.Scan(&ret); err != nil {
-				return nil, err
+				return "", nil, fmt.Errorf("unknown %s command: %v", cmd, query)
 			}
-			return []types.Result{ret}, nil
+			return cmd, parts[1:], nil
 		default:
 		}
 	}
-	return nil, fmt.Errorf("unsupported query %s", query)
+	return "", nil, fmt.Errorf("unsupported query %s", query)
+}
+
+func (d *redisDriver) Validate(ds *types.DataSource, query string) error {
+	if _, err := redis.ParseURL(ds.URI); err != nil {
+		return err
+	}
+	_, _, err := parseCommand(query)
+	return err
+}
+
+func doQuery(ctx context.Context, client *redis.Client, query string) ([]types.Result, error) {
+	cmd, args, err := parseCommand(query)
+	if err != nil {
+		return nil, err
+	}
+	switch cmd {
+	case "get":
+		res, err := client.Get(ctx, args[0]).Result()
+		return []types.Result{{valueKeyName: res}}, err
+	case "hget":
+		res, err := client.HGet(ctx, args[0], args[1]).Result()
+		return []types.Result{{valueKeyName: res}}, err
+	default:
+		res := client.HGetAll(ctx, args[0])
+		if res.Err() != nil {
+			return nil, res.Err()
+		}
+		var ret types.Result
+		if err := res.Scan(&ret); err != nil {
+			return nil, err
+		}
+		return []types.Result{ret}, nil
+	}
 }
 
+var (
+	poolLabels         = []string{"server"}
+	poolHitsDesc       = prometheus.NewDesc("redis_pool_hits_total", "Total number of times a free connection was found in the pool.", poolLabels, nil)
+	poolMissesDesc     = prometheus.NewDesc("redis_pool_misses_total", "Total number of times a free connection was not found in the pool.", poolLabels, nil)
+	poolTimeoutsDesc   = prometheus.NewDesc("redis_pool_timeouts_total", "Total number of times a wait timeout occurred.", poolLabels, nil)
+	poolTotalConnsDesc = prometheus.NewDesc("redis_pool_connections", "Number of connections in the pool.", poolLabels, nil)
+	poolIdleConnsDesc  = prometheus.NewDesc("redis_pool_idle_connections", "Number of idle connections in the pool.", poolLabels, nil)
+	poolStaleConnsDesc = prometheus.NewDesc("redis_pool_stale_connections_total", "Total number of stale connections removed from the pool.", poolLabels, nil)
+)
+
+// Describe implements prometheus.Collector for statistics of connection pools
+func (d *redisDriver) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolHitsDesc
+	ch <- poolMissesDesc
+	ch <- poolTimeoutsDesc
+	ch <- poolTotalConnsDesc
+	ch <- poolIdleConnsDesc
+	ch <- poolStaleConnsDesc
+}
+
+// Collect implements prometheus.Collector for statistics of connection pools
+func (d *redisDriver) Collect(ch chan<- prometheus.Metric) {
+	d.clients.Range(func(server string, client *redis.Client) {
+		stats := client.PoolStats()
+		ch <- prometheus.MustNewConstMetric(poolHitsDesc, prometheus.CounterValue, float64(stats.Hits), server)
+		ch <- prometheus.MustNewConstMetric(poolMissesDesc, prometheus.CounterValue, float64(stats.Misses), server)
+		ch <- prometheus.MustNewConstMetric(poolTimeoutsDesc, prometheus.CounterValue, float64(stats.Timeouts), server)
+		ch <- prometheus.MustNewConstMetric(poolTotalConnsDesc, prometheus.GaugeValue, float64(stats.TotalConns), server)
+		ch <- prometheus.MustNewConstMetric(poolIdleConnsDesc, prometheus.GaugeValue, float64(stats.IdleConns), server)
+		ch <- prometheus.MustNewConstMetric(poolStaleConnsDesc, prometheus.CounterValue, float64(stats.StaleConns), server)
+	})
+}
+
+var _ factory.Driver = (*redisDriver)(nil)
+
 func init() {
-	factory.Register(name, &redisDriver{})
+	factory.Register(name, newDriver())
 }
@@ -0,0 +1,69 @@
+package redis
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		query   string
+		cmd     string
+		args    []string
+		wantErr bool
+	}{
+		{query: "GET key", cmd: "get", args: []string{"key"}},
+		{query: "  hget  key\tfield\n", cmd: "hget", args: []string{"key", "field"}},
+		{query: "HGETALL key", cmd: "hgetall", args: []string{"key"}},
+		{query: "GET key extra", wantErr: true},
+		{query: "HGET key", wantErr: true},
+		{query: "HGETALL key field", wantErr: true},
+		{query: "SET key value", wantErr: true},
+		{query: "GET", wantErr: true},
+		{query: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			cmd, args, err := parseCommand(tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if cmd != tt.cmd || !reflect.DeepEqual(args, tt.args) {
+				t.Fatalf("got %s %v, want %s %v", cmd, args, tt.cmd, tt.args)
+			}
+		})
+	}
+}
+
+func TestPoolStats(t *testing.T) {
+	d := newDriver()
+	defer d.Close()
+	ds := &types.DataSource{Server: types.Server{Name: "cache", URI: "redis://localhost:6379/0"}, Pool: &types.PoolConfig{MaxOpen: 3}}
+	if err := d.clients.Open(context.Background(), ds); err != nil {
+		t.Fatal(err)
+	}
+	var size int
+	if err := d.clients.Peek(context.Background(), ds, func(client *redis.Client) error {
+		size = client.Options().PoolSize
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if size != 3 {
+		t.Fatalf("got pool size %d, want 3", size)
+	}
+	if err := testutil.CollectAndCompare(d, strings.NewReader(`
+# HELP redis_pool_connections Number of connections in the pool.
+# TYPE redis_pool_connections gauge
+redis_pool_connections{server="cache"} 0
+`), "redis_pool_connections"); err != nil {
+		t.Fatal(err)
+	}
+}
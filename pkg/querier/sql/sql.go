@@ -3,82 +3,236 @@ package sql
 import (
 	"context"
 	"database/sql"
-	"sync"
+	"database/sql/driver"
+	"errors"
+	"iter"
+	"strings"
+	"time"
 
-	_ "github.com/go-sql-driver/mysql"
-	_ "github.com/lib/pq"
-	"go.uber.org/multierr"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
 
+	"github.com/fengxsong/queryexporter/pkg/querier/conn"
 	"github.com/fengxsong/queryexporter/pkg/querier/factory"
 	"github.com/fengxsong/queryexporter/pkg/types"
 )
 
 type sqlDriver struct {
 	driverName string
-	cached     sync.Map
+	clients    *conn.Manager[*sql.DB]
 }
 
-func (d *sqlDriver) getCachedClient(uri string) (*sql.DB, error) {
-	val, ok := d.cached.Load(uri)
-	if ok {
-		return val.(*sql.DB), nil
-	}
+func newDriver(driverName string) *sqlDriver {
+	d := &sqlDriver{driverName: driverName}
+	d.clients = conn.New(conn.Options[*sql.DB]{
+		Open:        d.open,
+		Close:       (*sql.DB).Close,
+		IsAuthError: isAuthError,
+	})
+	return d
+}
 
-	db, err := sql.Open(d.driverName, uri)
+func (d *sqlDriver) open(_ context.Context, ds *types.DataSource) (*sql.DB, error) {
+	db, err := sql.Open(d.driverName, ds.URI)
 	if err != nil {
 		return nil, err
 	}
-	d.cached.Store(uri, db)
+	if pool := ds.Pool; pool != nil {
+		if pool.MaxOpen > 0 {
+			db.SetMaxOpenConns(pool.MaxOpen)
+		}
+		if pool.MaxIdle > 0 {
+			db.SetMaxIdleConns(pool.MaxIdle)
+		}
+		if pool.MaxLifetime > 0 {
+			db.SetConnMaxLifetime(time.Duration(pool.MaxLifetime))
+		}
+		if pool.MaxIdleTime > 0 {
+			db.SetConnMaxIdleTime(time.Duration(pool.MaxIdleTime))
+		}
+	}
 	return db, nil
 }
 
-func (d *sqlDriver) Query(ctx context.Context, ds *types.DataSource, query string) ([]types.Result, error) {
-	db, err := d.getCachedClient(ds.URI)
-	if err != nil {
-		return nil, err
+func isAuthError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		// ER_ACCESS_DENIED_ERROR
+		return mysqlErr.Number == 1045
 	}
-	rows, err := db.Query(query)
-	if err != nil {
-		return nil, err
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// invalid_authorization_specification and invalid_password
+		return pqErr.Code == "28000" || pqErr.Code == "28P01"
 	}
-	cols, err := rows.Columns() // just ignore error?
-	if err != nil {
-		return nil, err
+	return false
+}
+
+// Classify implements factory.ErrorClassifier
+func (d *sqlDriver) Classify(err error) string {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) {
+		return types.ErrorClassConnection
 	}
-	var (
-		rets []types.Result
-		errs []error
-	)
-	for rows.Next() {
-		columns := make([]interface{}, len(cols))
-		columnPointers := make([]interface{}, len(cols))
-		for i := range columns {
-			columnPointers[i] = &columns[i]
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch mysqlErr.Number {
+		// ER_CON_COUNT_ERROR, ER_TOO_MANY_USER_CONNECTIONS
+		case 1040, 1203:
+			return types.ErrorClassThrottled
+		// ER_LOCK_WAIT_TIMEOUT, ER_LOCK_DEADLOCK, ER_SERVER_SHUTDOWN
+		case 1205, 1213, 1053:
+			return types.ErrorClassUnavailable
 		}
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch {
+		// connection_exception
+		case pqErr.Code.Class() == "08":
+			return types.ErrorClassConnection
+		// too_many_connections
+		case pqErr.Code == "53300":
+			return types.ErrorClassThrottled
+		// insufficient_resources, operator_intervention like admin_shutdown,
+		// serialization_failure and deadlock_detected
+		case pqErr.Code.Class() == "53", pqErr.Code.Class() == "57",
+			pqErr.Code == "40001", pqErr.Code == "40P01":
+			return types.ErrorClassUnavailable
+		}
+	}
+	return types.ErrorClassPermanent
+}
+
+func (d *sqlDriver) Open(ctx context.Context, ds *types.DataSource) error {
+	return d.clients.Open(ctx, ds)
+}
+
+func (d *sqlDriver) Query(ctx context.Context, ds *types.DataSource, query string) ([]types.Result, error) {
+	return factory.Collect(d.Stream(ctx, ds, query))
+}
 
-		// Scan the result into the column pointers...
-		if err := rows.Scan(columnPointers...); err != nil {
-			// OR do fast return?
-			errs = append(errs, err)
-			continue
+// Stream yields rows as they are read. Credentials rejected by the server are
+// retried by the client manager before the first row is read, and the client is
+// kept open until rows are closed.
+func (d *sqlDriver) Stream(ctx context.Context, ds *types.DataSource, query string) iter.Seq2[types.Result, error] {
+	return func(yield func(types.Result, error) bool) {
+		var rows *sql.Rows
+		release, err := d.clients.Borrow(ctx, ds, func(db *sql.DB) (err error) {
+			rows, err = db.QueryContext(ctx, query)
+			return err
+		})
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		defer release()
+		defer rows.Close()
+		cols, err := rows.Columns()
+		if err != nil {
+			yield(nil, err)
+			return
 		}
+		for rows.Next() {
+			columns := make([]interface{}, len(cols))
+			columnPointers := make([]interface{}, len(cols))
+			for i := range columns {
+				columnPointers[i] = &columns[i]
+			}
+
+			// Scan the result into the column pointers...
+			if err := rows.Scan(columnPointers...); err != nil {
+				yield(nil, err)
+				return
+			}
 
-		// Create our map, and retrieve the value for each column from the pointers slice,
-		// storing it in the map with the name of the column as the key.
-		m := make(types.Result)
-		for i, colName := range cols {
-			val := columnPointers[i].(*interface{})
-			m[colName] = *val
+			// Create our map, and retrieve the value for each column from the pointers slice,
+			// storing it in the map with the name of the column as the key.
+			m := make(types.Result, len(cols))
+			for i, colName := range cols {
+				val := columnPointers[i].(*interface{})
+				m[colName] = *val
+			}
+			if !yield(m, nil) {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			yield(nil, err)
 		}
-		rets = append(rets, m)
 	}
-	if len(errs) > 0 {
-		return nil, multierr.Combine(errs...)
+}
+
+func (d *sqlDriver) Ping(ctx context.Context, ds *types.DataSource) error {
+	return d.clients.Peek(ctx, ds, func(db *sql.DB) error {
+		return db.PingContext(ctx)
+	})
+}
+
+func (d *sqlDriver) Close() error {
+	return d.clients.Close()
+}
+
+func (d *sqlDriver) Validate(_ *types.DataSource, query string) error {
+	if strings.TrimSpace(query) == "" {
+		return errors.New("empty sql statement")
 	}
-	return rets, nil
+	return nil
+}
+
+var (
+	poolLabels            = []string{"driver", "server"}
+	poolOpenDesc          = prometheus.NewDesc("sql_pool_open_connections", "Number of established connections both in use and idle.", poolLabels, nil)
+	poolInUseDesc         = prometheus.NewDesc("sql_pool_in_use_connections", "Number of connections currently in use.", poolLabels, nil)
+	poolIdleDesc          = prometheus.NewDesc("sql_pool_idle_connections", "Number of idle connections.", poolLabels, nil)
+	poolMaxOpenDesc       = prometheus.NewDesc("sql_pool_max_open_connections", "Maximum number of open connections, 0 means unlimited.", poolLabels, nil)
+	poolWaitCountDesc     = prometheus.NewDesc("sql_pool_wait_count_total", "Total number of connections waited for.", poolLabels, nil)
+	poolWaitDurationDesc  = prometheus.NewDesc("sql_pool_wait_duration_seconds_total", "Total time blocked waiting for a new connection.", poolLabels, nil)
+	poolMaxIdleClosedDesc = prometheus.NewDesc("sql_pool_max_idle_closed_total", "Total number of connections closed due to maxIdle.", poolLabels, nil)
+	poolMaxIdleTimeDesc   = prometheus.NewDesc("sql_pool_max_idle_time_closed_total", "Total number of connections closed due to maxIdleTime.", poolLabels, nil)
+	poolMaxLifetimeDesc   = prometheus.NewDesc("sql_pool_max_lifetime_closed_total", "Total number of connections closed due to maxLifetime.", poolLabels, nil)
+)
+
+// Describe implements prometheus.Collector for statistics of connection pools
+func (d *sqlDriver) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolOpenDesc
+	ch <- poolInUseDesc
+	ch <- poolIdleDesc
+	ch <- poolMaxOpenDesc
+	ch <- poolWaitCountDesc
+	ch <- poolWaitDurationDesc
+	ch <- poolMaxIdleClosedDesc
+	ch <- poolMaxIdleTimeDesc
+	ch <- poolMaxLifetimeDesc
 }
 
+// Collect implements prometheus.Collector for statistics of connection pools
+func (d *sqlDriver) Collect(ch chan<- prometheus.Metric) {
+	d.clients.Range(func(server string, db *sql.DB) {
+		stats := db.Stats()
+		for _, m := range []struct {
+			desc  *prometheus.Desc
+			typ   prometheus.ValueType
+			value float64
+		}{
+			{poolOpenDesc, prometheus.GaugeValue, float64(stats.OpenConnections)},
+			{poolInUseDesc, prometheus.GaugeValue, float64(stats.InUse)},
+			{poolIdleDesc, prometheus.GaugeValue, float64(stats.Idle)},
+			{poolMaxOpenDesc, prometheus.GaugeValue, float64(stats.MaxOpenConnections)},
+			{poolWaitCountDesc, prometheus.CounterValue, float64(stats.WaitCount)},
+			{poolWaitDurationDesc, prometheus.CounterValue, stats.WaitDuration.Seconds()},
+			{poolMaxIdleClosedDesc, prometheus.CounterValue, float64(stats.MaxIdleClosed)},
+			{poolMaxIdleTimeDesc, prometheus.CounterValue, float64(stats.MaxIdleTimeClosed)},
+			{poolMaxLifetimeDesc, prometheus.CounterValue, float64(stats.MaxLifetimeClosed)},
+		} {
+			ch <- prometheus.MustNewConstMetric(m.desc, m.typ, m.value, d.driverName, server)
+		}
+	})
+}
+
+var _ factory.Driver = (*sqlDriver)(nil)
+
 func init() {
-	factory.Register("mysql", &sqlDriver{driverName: "mysql"})
-	factory.Register("postgres", &sqlDriver{driverName: "postgres"})
+	factory.Register("mysql", newDriver("mysql"))
+	factory.Register("postgres", newDriver("postgres"))
 }
@@ -0,0 +1,43 @@
+package sql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "bad connection", err: fmt.Errorf("query: %w", driver.ErrBadConn), want: types.ErrorClassConnection},
+		{name: "invalid mysql connection", err: mysql.ErrInvalidConn, want: types.ErrorClassConnection},
+		{name: "mysql too many connections", err: &mysql.MySQLError{Number: 1040}, want: types.ErrorClassThrottled},
+		{name: "mysql deadlock", err: &mysql.MySQLError{Number: 1213}, want: types.ErrorClassUnavailable},
+		{name: "mysql syntax error", err: &mysql.MySQLError{Number: 1064}, want: types.ErrorClassPermanent},
+		{name: "postgres connection failure", err: &pq.Error{Code: "08006"}, want: types.ErrorClassConnection},
+		{name: "postgres too many connections", err: &pq.Error{Code: "53300"}, want: types.ErrorClassThrottled},
+		{name: "postgres admin shutdown", err: &pq.Error{Code: "57P01"}, want: types.ErrorClassUnavailable},
+		{name: "postgres serialization failure", err: &pq.Error{Code: "40001"}, want: types.ErrorClassUnavailable},
+		{name: "postgres undefined table", err: &pq.Error{Code: "42P01"}, want: types.ErrorClassPermanent},
+		{name: "cancelled", err: context.Canceled, want: types.ErrorClassPermanent},
+		{name: "other", err: errors.New("sql: no rows in result set"), want: types.ErrorClassPermanent},
+	}
+	d := newDriver("mysql")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := d.Classify(tt.err); got != tt.want {
+				t.Fatalf("got class %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
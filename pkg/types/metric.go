@@ -11,6 +11,9 @@ const (
 	TypeGauge = "gauge"
 )
 
+// MetricTypes lists all supported values of MetricDesc.Type
+var MetricTypes = []string{TypeGauge}
+
 type MetricDesc struct {
 	Name            string            `json:"name"`
 	Help            string            `json:"help"`
@@ -21,6 +24,13 @@ type MetricDesc struct {
 	ConstLabels     prometheus.Labels `json:"constLabels,omitempty"`
 	ContinueIfError bool              `json:"continueIfError,omitempty"`
 	AllowEmptyValue bool              `json:"allowEmptyValue,omitempty"`
+	// Retry overrides the retry policy of servers
+	Retry *RetryPolicy `json:"retry,omitempty"`
+}
+
+// Enums returns allowed values of fields by name
+func (*MetricDesc) Enums() map[string][]string {
+	return map[string][]string{"Type": MetricTypes}
 }
 
 func (m *MetricDesc) String() string {
@@ -36,18 +46,29 @@ func (m *MetricDesc) Validate() error {
 	if m.VariableValue == "" {
 		return fmt.Errorf("variableValue field must specified for metric %s", m.Name)
 	}
+	if m.Retry != nil {
+		if err := m.Retry.Validate(); err != nil {
+			return fmt.Errorf("invalid retry of metric %s, err: %v", m.Name, err)
+		}
+	}
 	return nil
 }
 
-func (m *MetricDesc) ToDesc(namespace, subsystem string, labels ...string) *prometheus.Desc {
-	if len(labels) < 3 {
-		panic("Must include builtin labels name/database/table")
-	}
+// LabelNames returns names of variable labels, json path separators are replaced
+// with underscores to make them valid label names.
+func (m *MetricDesc) LabelNames() []string {
 	var variableLabels []string
 	for i := range m.VariableLabels {
 		variableLabels = append(variableLabels, strings.ReplaceAll(m.VariableLabels[i], ".", "_"))
 	}
-	variableLabels = append(variableLabels, labels...)
+	return variableLabels
+}
+
+func (m *MetricDesc) ToDesc(namespace, subsystem string, labels ...string) *prometheus.Desc {
+	if len(labels) < 3 {
+		panic("Must include builtin labels name/database/table")
+	}
+	variableLabels := append(m.LabelNames(), labels...)
 
 	return prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, subsystem, m.Name),
@@ -66,26 +66,50 @@ func jsonPathGet(objects map[string]any, key string) any {
 	return nil
 }
 
-var builtinLabels = []string{"name", "database", "table"}
+// BuiltinLabels are attached to every metric to identify the datasource
+var BuiltinLabels = []string{"name", "database", "table"}
 
-func CreateGaugeMetric(namespace, subsystem string, ds *DataSource, m *MetricDesc, ret Result) (prometheus.Metric, error) {
+// GaugeBuilder creates gauge metrics from results of a metric queried against a datasource.
+// The descriptor is built once for all results, and the buffer of label values is reused
+// between results, so it's not safe for concurrent use.
+type GaugeBuilder struct {
+	desc        *prometheus.Desc
+	ds          *DataSource
+	m           *MetricDesc
+	labelValues []string
+}
+
+func NewGaugeBuilder(namespace, subsystem string, ds *DataSource, m *MetricDesc) *GaugeBuilder {
+	return &GaugeBuilder{
+		desc:        m.ToDesc(namespace, subsystem, BuiltinLabels...),
+		ds:          ds,
+		m:           m,
+		labelValues: make([]string, 0, len(m.VariableLabels)+len(BuiltinLabels)),
+	}
+}
+
+func (b *GaugeBuilder) Build(ret Result) (prometheus.Metric, error) {
 	var (
 		val float64
 		err error
 	)
-	if ret.IsEmpty() && m.AllowEmptyValue {
+	if ret.IsEmpty() && b.m.AllowEmptyValue {
 		val = 0
 	} else {
-		val, err = ret.GetValue(m.VariableValue)
+		val, err = ret.GetValue(b.m.VariableValue)
 	}
 	if err != nil {
 		return nil, err
 	}
-	labelValues := make([]string, 0, len(m.VariableLabels)+len(builtinLabels))
-	desc := m.ToDesc(namespace, subsystem, builtinLabels...)
-	for _, labelVar := range m.VariableLabels {
+	// label values are copied into label pairs of the metric, the buffer can be reused
+	labelValues := b.labelValues[:0]
+	for _, labelVar := range b.m.VariableLabels {
 		labelValues = append(labelValues, ret.Get(labelVar))
 	}
-	labelValues = append(labelValues, ds.Name, ds.Database, ds.Table)
-	return prometheus.NewConstMetric(desc, prometheus.GaugeValue, val, labelValues...)
+	labelValues = append(labelValues, b.ds.Name, b.ds.Database, b.ds.Table)
+	return prometheus.NewConstMetric(b.desc, prometheus.GaugeValue, val, labelValues...)
+}
+
+func CreateGaugeMetric(namespace, subsystem string, ds *DataSource, m *MetricDesc, ret Result) (prometheus.Metric, error) {
+	return NewGaugeBuilder(namespace, subsystem, ds, m).Build(ret)
 }
@@ -0,0 +1,142 @@
+package types
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestGaugeBuilder(t *testing.T) {
+	ds := &DataSource{Server: Server{Name: "primary"}, Database: "shop", Table: "orders"}
+	tests := []struct {
+		name       string
+		metric     *MetricDesc
+		ret        Result
+		wantValue  float64
+		wantLabels map[string]string
+		wantErr    bool
+	}{
+		{
+			name:       "value and labels",
+			metric:     &MetricDesc{Name: "orders", VariableValue: "count", VariableLabels: []string{"status"}},
+			ret:        Result{"count": 3, "status": "paid"},
+			wantValue:  3,
+			wantLabels: map[string]string{"status": "paid", "name": "primary", "database": "shop", "table": "orders"},
+		},
+		{
+			name:       "nested label",
+			metric:     &MetricDesc{Name: "orders_by_region", VariableValue: "count", VariableLabels: []string{"region.name"}},
+			ret:        Result{"count": []byte("1.5"), "region": map[string]any{"name": "eu"}},
+			wantValue:  1.5,
+			wantLabels: map[string]string{"region_name": "eu", "name": "primary", "database": "shop", "table": "orders"},
+		},
+		{
+			name:       "empty allowed",
+			metric:     &MetricDesc{Name: "orders_empty", VariableValue: "count", AllowEmptyValue: true},
+			ret:        Result{},
+			wantLabels: map[string]string{"name": "primary", "database": "shop", "table": "orders"},
+		},
+		{
+			name:    "missing value",
+			metric:  &MetricDesc{Name: "orders_missing", VariableValue: "count"},
+			ret:     Result{"other": 1},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewGaugeBuilder("test", "mysql", ds, tt.metric).Build(tt.ret)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			pb := &dto.Metric{}
+			if err = m.Write(pb); err != nil {
+				t.Fatal(err)
+			}
+			if got := pb.GetGauge().GetValue(); got != tt.wantValue {
+				t.Fatalf("got value %v, want %v", got, tt.wantValue)
+			}
+			labels := make(map[string]string)
+			for _, lp := range pb.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			if len(labels) != len(tt.wantLabels) {
+				t.Fatalf("got labels %v, want %v", labels, tt.wantLabels)
+			}
+			for name, value := range tt.wantLabels {
+				if labels[name] != value {
+					t.Fatalf("got labels %v, want %v", labels, tt.wantLabels)
+				}
+			}
+		})
+	}
+}
+
+func TestGaugeBuilderDescOfMetric(t *testing.T) {
+	ds := &DataSource{Server: Server{Name: "primary"}}
+	// metrics of the same name, e.g. from configs loaded in turn, get descriptors of their own
+	for _, env := range []string{"staging", "production"} {
+		m := &MetricDesc{Name: "orders", Help: "orders of " + env, VariableValue: "count", ConstLabels: prometheus.Labels{"env": env}}
+		metric, err := NewGaugeBuilder("test", "mysql", ds, m).Build(Result{"count": 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if desc := metric.Desc().String(); !strings.Contains(desc, `env="`+env+`"`) || !strings.Contains(desc, m.Help) {
+			t.Fatalf("got descriptor %s, want the one of env %s", desc, env)
+		}
+	}
+}
+
+func benchmarkResults(n int) []Result {
+	rets := make([]Result, n)
+	for i := range rets {
+		rets[i] = Result{"count": i, "status": "status" + strconv.Itoa(i%10), "region": "region" + strconv.Itoa(i%5)}
+	}
+	return rets
+}
+
+var (
+	benchmarkDataSource = &DataSource{Server: Server{Name: "primary"}, Database: "shop", Table: "orders"}
+	benchmarkMetric     = &MetricDesc{Name: "orders", Help: "orders by status", VariableValue: "count", VariableLabels: []string{"status", "region"}}
+)
+
+func BenchmarkGaugeBuilder(b *testing.B) {
+	rets := benchmarkResults(5000)
+	b.ReportAllocs()
+	for b.Loop() {
+		builder := NewGaugeBuilder("test", "mysql", benchmarkDataSource, benchmarkMetric)
+		for _, ret := range rets {
+			if _, err := builder.Build(ret); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkToDesc measures building a descriptor and label values for every result,
+// as metrics were created before descriptors were cached
+func BenchmarkToDesc(b *testing.B) {
+	rets := benchmarkResults(5000)
+	b.ReportAllocs()
+	for b.Loop() {
+		for _, ret := range rets {
+			val, err := ret.GetValue(benchmarkMetric.VariableValue)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var labelValues []string
+			for _, labelVar := range benchmarkMetric.VariableLabels {
+				labelValues = append(labelValues, ret.Get(labelVar))
+			}
+			labelValues = append(labelValues, benchmarkDataSource.Name, benchmarkDataSource.Database, benchmarkDataSource.Table)
+			desc := benchmarkMetric.ToDesc("test", "mysql", BuiltinLabels...)
+			prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, val, labelValues...)
+		}
+	}
+}
@@ -1,12 +1,124 @@
 package types
 
-import "strings"
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
 
 type DataSourceType string
 
+// Server is a server queried by metrics. Fields with the scope:"server" tag apply to the
+// server as a whole, so they can't be set on datasources inlining it.
 type Server struct {
-	Name string `json:"name"`
-	URI  string `json:"uri"`
+	Name string      `json:"name"`
+	URI  string      `json:"uri"`
+	Pool *PoolConfig `json:"pool,omitempty" scope:"server"`
+	// MaxConcurrentQueries is the maximum number of in-flight queries against the server,
+	// zero means unlimited
+	MaxConcurrentQueries int `json:"maxConcurrentQueries,omitempty" scope:"server"`
+	// RateLimit caps queries per second against the server, it's unlimited if nil
+	RateLimit *RateLimit `json:"rateLimit,omitempty" scope:"server"`
+	// CircuitBreaker fails queries fast while the server keeps failing, it's disabled if nil
+	CircuitBreaker *CircuitBreaker `json:"circuitBreaker,omitempty" scope:"server"`
+	// Retry is the retry policy of queries against the server, the one of a metric takes precedence
+	Retry *RetryPolicy `json:"retry,omitempty" scope:"server"`
+}
+
+// ServerWideFields returns json names of the fields with the scope:"server" tag set on s
+func (s Server) ServerWideFields() []string {
+	var names []string
+	v := reflect.ValueOf(s)
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.Tag.Get("scope") == "server" && !v.Field(i).IsZero() {
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// CircuitBreaker opens after FailureThreshold consecutive failed queries, and lets a
+// single query probe the server once OpenTimeout passes.
+type CircuitBreaker struct {
+	FailureThreshold int            `json:"failureThreshold,omitempty" default:"5"`
+	OpenTimeout      model.Duration `json:"openTimeout,omitempty"`
+}
+
+// SetDefaults implements defaults.Setter
+func (c *CircuitBreaker) SetDefaults() {
+	if c.OpenTimeout == 0 {
+		c.OpenTimeout = model.Duration(30 * time.Second)
+	}
+}
+
+func (c *CircuitBreaker) Validate() error {
+	if c.FailureThreshold < 1 {
+		return fmt.Errorf("failureThreshold must be at least 1")
+	}
+	if c.OpenTimeout <= 0 {
+		return fmt.Errorf("openTimeout must be positive")
+	}
+	return nil
+}
+
+const (
+	// RateLimitPolicyWait delays queries over the limit until a token is available
+	RateLimitPolicyWait = "wait"
+	// RateLimitPolicyLastResult serves queries over the limit from the last results of
+	// the same query, queries without previous results wait
+	RateLimitPolicyLastResult = "lastResult"
+)
+
+// RateLimitPolicies lists all supported values of RateLimit.Policy
+var RateLimitPolicies = []string{RateLimitPolicyWait, RateLimitPolicyLastResult}
+
+// RateLimit is a token bucket refilled at QueriesPerSecond and holding up to Burst tokens
+type RateLimit struct {
+	QueriesPerSecond float64 `json:"queriesPerSecond"`
+	Burst            int     `json:"burst,omitempty" default:"1"`
+	Policy           string  `json:"policy,omitempty" default:"wait"`
+}
+
+// Enums returns allowed values of fields by name
+func (*RateLimit) Enums() map[string][]string {
+	return map[string][]string{"Policy": RateLimitPolicies}
+}
+
+func (r *RateLimit) Validate() error {
+	if r.QueriesPerSecond <= 0 {
+		return fmt.Errorf("queriesPerSecond must be positive")
+	}
+	if r.Burst < 1 {
+		return fmt.Errorf("burst must be at least 1")
+	}
+	switch r.Policy {
+	case RateLimitPolicyWait, RateLimitPolicyLastResult:
+	default:
+		return fmt.Errorf("unsupported policy %s", r.Policy)
+	}
+	return nil
+}
+
+// PoolConfig configures connection pool of the client of a server, zero values
+// keep defaults of the underlying driver.
+type PoolConfig struct {
+	// MaxOpen is the maximum number of open connections,
+	// it maps to MaxOpenConns of sql, PoolSize of redis and MaxPoolSize of mongo
+	MaxOpen int `json:"maxOpen,omitempty"`
+	// MaxIdle is the maximum number of idle connections, sql only
+	MaxIdle int `json:"maxIdle,omitempty"`
+	// MaxLifetime is the maximum amount of time a connection may be reused,
+	// it maps to ConnMaxLifetime of sql and MaxConnAge of redis
+	MaxLifetime model.Duration `json:"maxLifetime,omitempty"`
+	// MaxIdleTime is the maximum amount of time a connection may be idle,
+	// it maps to ConnMaxIdleTime of sql, IdleTimeout of redis and MaxConnIdleTime of mongo
+	MaxIdleTime model.Duration `json:"maxIdleTime,omitempty"`
 }
 
 func (s Server) String() string {
@@ -19,6 +131,10 @@ type DataSource struct {
 	Server   `json:",inline"`
 	Database string `json:"database"`
 	Table    string `json:"table"`
+	// Pool and Retry are taken from the server at config load, they shadow the ones of
+	// the inlined server which can't be set on datasources, and are left out of dumps.
+	Pool  *PoolConfig  `json:"-"`
+	Retry *RetryPolicy `json:"-"`
 }
 
 func (ds DataSource) String() string {
@@ -35,6 +151,71 @@ func (dss DataSources) String() string {
 	return strings.Join(r, ",")
 }
 
+// classes of query errors, all classes but ErrorClassPermanent are transient
+const (
+	ErrorClassConnection  = "connection"
+	ErrorClassTimeout     = "timeout"
+	ErrorClassUnavailable = "unavailable"
+	ErrorClassThrottled   = "throttled"
+	ErrorClassPermanent   = "permanent"
+)
+
+// TransientErrorClasses lists classes of errors which may succeed on retry
+var TransientErrorClasses = []string{ErrorClassConnection, ErrorClassTimeout, ErrorClassUnavailable, ErrorClassThrottled}
+
+// RetryPolicy retries queries failed with transient errors, with exponential backoff
+// starting at InitialBackoff and capped at MaxBackoff.
+type RetryPolicy struct {
+	// Attempts is the maximum number of attempts including the first one
+	Attempts       int            `json:"attempts,omitempty" default:"3"`
+	InitialBackoff model.Duration `json:"initialBackoff,omitempty"`
+	MaxBackoff     model.Duration `json:"maxBackoff,omitempty"`
+	// MaxElapsed caps the time since the first attempt, no retry ends after it
+	MaxElapsed model.Duration `json:"maxElapsed,omitempty"`
+	// RetryOn lists classes of errors to retry, all transient classes by default,
+	// the key isn't on since YAML 1.1 reads it as a boolean
+	RetryOn []string `json:"retryOn,omitempty"`
+}
+
+// Enums returns allowed values of fields by name
+func (*RetryPolicy) Enums() map[string][]string {
+	return map[string][]string{"RetryOn": TransientErrorClasses}
+}
+
+// SetDefaults implements defaults.Setter
+func (r *RetryPolicy) SetDefaults() {
+	if r.InitialBackoff == 0 {
+		r.InitialBackoff = model.Duration(100 * time.Millisecond)
+	}
+	if r.MaxBackoff == 0 {
+		r.MaxBackoff = model.Duration(5 * time.Second)
+	}
+	if r.MaxElapsed == 0 {
+		r.MaxElapsed = model.Duration(30 * time.Second)
+	}
+	if len(r.RetryOn) == 0 {
+		r.RetryOn = TransientErrorClasses
+	}
+}
+
+func (r *RetryPolicy) Validate() error {
+	if r.Attempts < 1 {
+		return fmt.Errorf("attempts must be at least 1")
+	}
+	if r.InitialBackoff < 0 || r.MaxBackoff < r.InitialBackoff {
+		return fmt.Errorf("backoff must not be negative, and maxBackoff must not be less than initialBackoff")
+	}
+	if r.MaxElapsed <= 0 {
+		return fmt.Errorf("maxElapsed must be positive")
+	}
+	for _, class := range r.RetryOn {
+		if !slices.Contains(TransientErrorClasses, class) {
+			return fmt.Errorf("unsupported error class %s", class)
+		}
+	}
+	return nil
+}
+
 type Metric struct {
 	*MetricDesc `json:",inline"`
 	DataSources DataSources `json:"datasources"`
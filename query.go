@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/fengxsong/queryexporter/pkg/config"
+	"github.com/fengxsong/queryexporter/pkg/querier/factory"
+	"github.com/fengxsong/queryexporter/pkg/types"
+)
+
+type queryOptions struct {
+	configFile string
+	expandEnv  bool
+	namespace  string
+	metric     string
+	driver     string
+	datasource string
+	timeout    time.Duration
+}
+
+// staticCollector is an unchecked collector which emits a fixed set of metrics
+type staticCollector []prometheus.Metric
+
+func (c staticCollector) Describe(_ chan<- *prometheus.Desc) {}
+
+func (c staticCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range c {
+		ch <- m
+	}
+}
+
+// runQuery executes a single metric without starting the HTTP server, and prints the
+// rendered query, raw results and produced series of every datasource.
+func runQuery(logger *slog.Logger, opts queryOptions, w io.Writer) error {
+	cfg, err := config.ReadFromFile(opts.configFile, opts.expandEnv)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, driver := range sortedDrivers(cfg) {
+		if opts.driver != "" && string(driver) != opts.driver {
+			continue
+		}
+		for _, m := range cfg.Aggregations[driver] {
+			if m.Name != opts.metric {
+				continue
+			}
+			metric := &types.Metric{MetricDesc: m.MetricDesc}
+			for _, ds := range m.DataSources {
+				if opts.datasource == "" || ds.Name == opts.datasource {
+					metric.DataSources = append(metric.DataSources, ds)
+				}
+			}
+			if len(metric.DataSources) == 0 {
+				continue
+			}
+			found = true
+			if err = queryMetric(logger, opts, string(driver), metric, cfg.Vars, w); err != nil {
+				return err
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("metric %s not found", opts.metric)
+	}
+	return nil
+}
+
+func queryMetric(logger *slog.Logger, opts queryOptions, driver string, m *types.Metric, vars map[string]any, w io.Writer) error {
+	var mu sync.Mutex
+	tracer := func(ds *types.DataSource, query string, rets []types.Result, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, "# driver: %s, metric: %s, datasource: %s\n", driver, m.Name, ds.Name)
+		fmt.Fprintf(w, "## query\n%s\n", query)
+		if err != nil {
+			fmt.Fprintf(w, "## error\n%s\n\n", err)
+			return
+		}
+		out, err := json.MarshalIndent(rets, "", "  ")
+		if err != nil {
+			out = []byte(err.Error())
+		}
+		fmt.Fprintf(w, "## results\n%s\n\n", out)
+	}
+	ctx, cancel := context.WithTimeout(factory.WithVars(context.Background(), vars), opts.timeout)
+	defer cancel()
+
+	metrics, err := collectMetric(factory.WithTracer(ctx, tracer), logger, opts.namespace, driver, m)
+	if err != nil {
+		return err
+	}
+
+	reg := prometheus.NewRegistry()
+	if err = reg.Register(staticCollector(metrics)); err != nil {
+		return err
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "## series")
+	enc := expfmt.NewEncoder(w, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, mf := range mfs {
+		if err = enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(w)
+	return nil
+}
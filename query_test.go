@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunQuery(t *testing.T) {
+	srv := newTestServer(t, http.StatusOK, `[{"status": "paid", "count": 3}]`)
+	tests := []struct {
+		name       string
+		metric     string
+		datasource string
+		wantErr    string
+		want       []string
+	}{
+		{
+			name:   "series and results",
+			metric: "orders",
+			want: []string{
+				"# driver: http, metric: orders, datasource: api",
+				"## query\nuri: /orders",
+				`"status": "paid"`,
+				`test_query_http_orders{database="",name="api",status="paid",table=""} 3`,
+			},
+		},
+		{name: "unknown metric", metric: "missing", wantErr: "metric missing not found"},
+		{name: "unknown datasource", metric: "orders", datasource: "missing", wantErr: "metric orders not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			opts := queryOptions{
+				configFile: writeConfig(t, "orders", srv.URL),
+				namespace:  "test_query",
+				metric:     tt.metric,
+				datasource: tt.datasource,
+				timeout:    5 * time.Second,
+			}
+			err := runQuery(discardLogger, opts, &out)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(out.String(), want) {
+					t.Fatalf("output does not contain %q:\n%s", want, out.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fengxsong/queryexporter/pkg/config"
+	"github.com/fengxsong/queryexporter/pkg/querier/factory"
+)
+
+const (
+	readyPolicyAll = "all"
+	readyPolicyAny = "any"
+
+	statusUp      = "up"
+	statusDown    = "down"
+	statusUnknown = "unknown"
+)
+
+type serverStatus struct {
+	Server    string    `json:"server"`
+	Driver    string    `json:"driver"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+type readyResponse struct {
+	Ready   bool           `json:"ready"`
+	Policy  string         `json:"policy"`
+	Servers []serverStatus `json:"servers"`
+}
+
+// readiness pings servers in background and caches their statuses, so that probes
+// never wait on databases. Servers whose driver can't ping are reported as unknown
+// and ignored by the policy.
+type readiness struct {
+	refs     []serverRef
+	policy   string
+	required map[string]struct{}
+	interval time.Duration
+	timeout  time.Duration
+	logger   *slog.Logger
+
+	mu       sync.RWMutex
+	statuses []serverStatus
+}
+
+// newReadiness returns readiness of the servers in cfg. If servers is not empty, only
+// these servers are taken into account by the policy.
+func newReadiness(logger *slog.Logger, cfg *config.Config, policy string, servers []string, interval, timeout time.Duration) (*readiness, error) {
+	refs := serversOf(cfg)
+	required := make(map[string]struct{}, len(servers))
+	for _, name := range servers {
+		found := false
+		for _, ref := range refs {
+			if ref.ds.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("server %s is not used by any metric", name)
+		}
+		required[name] = struct{}{}
+	}
+	return &readiness{
+		refs:     refs,
+		policy:   policy,
+		required: required,
+		interval: interval,
+		timeout:  timeout,
+		logger:   logger,
+	}, nil
+}
+
+// run checks servers every interval until ctx is done
+func (r *readiness) run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		r.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *readiness) check(ctx context.Context) {
+	statuses := make([]serverStatus, len(r.refs))
+	var wg sync.WaitGroup
+	for i, ref := range r.refs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pctx, cancel := context.WithTimeout(ctx, r.timeout)
+			defer cancel()
+			err := factory.Default.Ping(pctx, ref.driver, ref.ds)
+			s := serverStatus{Server: ref.ds.Name, Driver: ref.driver, Status: statusUp, CheckedAt: time.Now()}
+			switch {
+			case errors.Is(err, factory.ErrNotSupported):
+				s.Status = statusUnknown
+			case err != nil:
+				s.Status, s.Error = statusDown, err.Error()
+				r.logger.Debug("server is unreachable", "server", ref.ds.Name, "driver", ref.driver, "err", err)
+			}
+			statuses[i] = s
+		}()
+	}
+	wg.Wait()
+
+	r.mu.Lock()
+	r.statuses = statuses
+	r.mu.Unlock()
+}
+
+// ready evaluates the policy against statuses. Before the first check completes
+// it's never ready.
+func (r *readiness) ready(statuses []serverStatus) bool {
+	if statuses == nil {
+		return false
+	}
+	considered, up := 0, 0
+	for _, s := range statuses {
+		if s.Status == statusUnknown {
+			continue
+		}
+		if _, ok := r.required[s.Server]; len(r.required) > 0 && !ok {
+			continue
+		}
+		considered++
+		if s.Status == statusUp {
+			up++
+		}
+	}
+	if r.policy == readyPolicyAny && considered > 0 {
+		return up > 0
+	}
+	return up == considered
+}
+
+func (r *readiness) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	r.mu.RLock()
+	statuses := r.statuses
+	r.mu.RUnlock()
+
+	resp := readyResponse{Ready: r.ready(statuses), Policy: r.policy, Servers: statuses}
+	if resp.Servers == nil {
+		resp.Servers = []serverStatus{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !resp.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
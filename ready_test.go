@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadiness(t *testing.T) {
+	up := serverStatus{Server: "primary", Status: statusUp}
+	down := serverStatus{Server: "replica", Status: statusDown, Error: "connection refused"}
+	unknown := serverStatus{Server: "cache", Status: statusUnknown}
+	tests := []struct {
+		name     string
+		policy   string
+		required []string
+		statuses []serverStatus
+		want     bool
+	}{
+		{name: "not checked yet", policy: readyPolicyAll, want: false},
+		{name: "all up", policy: readyPolicyAll, statuses: []serverStatus{up, unknown}, want: true},
+		{name: "all with one down", policy: readyPolicyAll, statuses: []serverStatus{up, down}, want: false},
+		{name: "any with one up", policy: readyPolicyAny, statuses: []serverStatus{up, down}, want: true},
+		{name: "any with all down", policy: readyPolicyAny, statuses: []serverStatus{down, unknown}, want: false},
+		{name: "only unknown", policy: readyPolicyAny, statuses: []serverStatus{unknown}, want: true},
+		{name: "required server up", policy: readyPolicyAll, required: []string{"primary"}, statuses: []serverStatus{up, down}, want: true},
+		{name: "required server down", policy: readyPolicyAll, required: []string{"replica"}, statuses: []serverStatus{up, down}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &readiness{policy: tt.policy, required: make(map[string]struct{})}
+			for _, name := range tt.required {
+				r.required[name] = struct{}{}
+			}
+			r.statuses = tt.statuses
+
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/-/ready", nil))
+			wantCode := http.StatusOK
+			if !tt.want {
+				wantCode = http.StatusServiceUnavailable
+			}
+			if rec.Code != wantCode {
+				t.Fatalf("got status code %d, want %d", rec.Code, wantCode)
+			}
+			var resp readyResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Ready != tt.want || resp.Policy != tt.policy || len(resp.Servers) != len(tt.statuses) {
+				t.Fatalf("unexpected response %+v", resp)
+			}
+		})
+	}
+}
+
+func TestReadinessCheck(t *testing.T) {
+	ok := newTestServer(t, http.StatusOK, "[]")
+	cfg := readConfig(t, writeConfig(t, "orders", ok.URL))
+	r, err := newReadiness(discardLogger, cfg, readyPolicyAll, nil, 0, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.check(t.Context())
+	if len(r.statuses) != 1 || r.statuses[0].Status != statusUp || !r.ready(r.statuses) {
+		t.Fatalf("unexpected statuses %+v", r.statuses)
+	}
+	if _, err = newReadiness(discardLogger, cfg, readyPolicyAll, []string{"missing"}, 0, testTimeout); err == nil {
+		t.Fatal("expected error of unknown server")
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/fengxsong/queryexporter/pkg/config"
+)
+
+// writeSchema writes JSON Schema of the config file into fn, or stdout if fn is empty
+func writeSchema(fn string) error {
+	var w io.Writer = os.Stdout
+	if fn != "" {
+		f, err := os.Create(fn)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(config.Schema())
+}